@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Completion item kinds and insert text formats, from the LSP specification.
+const (
+	kindFunction = 3
+	kindVariable = 6
+	kindFile     = 17
+	kindFolder   = 19
+
+	formatSnippet = 2
+)
+
+type completionItem struct {
+	Label            string         `json:"label"`
+	Kind             int            `json:"kind,omitempty"`
+	Detail           string         `json:"detail,omitempty"`
+	Documentation    *markupContent `json:"documentation,omitempty"`
+	InsertTextFormat int            `json:"insertTextFormat,omitempty"`
+	TextEdit         textEdit       `json:"textEdit"`
+}
+
+type textEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+func (s *server) handleCompletion(msg *request) error {
+	if msg.ID == nil {
+		return nil
+	}
+	var p struct {
+		TextDocument textDocumentIdentifier `json:"textDocument"`
+		Position     position               `json:"position"`
+	}
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return s.sendError(msg.ID, codeInvalidParams, err.Error())
+	}
+	items := []completionItem{}
+	if doc := s.docs[p.TextDocument.URI]; doc != nil {
+		items = append(items, doc.completions(p.Position.Line, p.Position.Character)...)
+	}
+	return s.reply(msg.ID, items)
+}
+
+// completions returns the completions at the given position:
+//
+//   - template names, where a command name is expected, at the start of a
+//     line or of a line in a define body
+//   - the parameters of the template, after $ or ${ in a define body
+//   - included files, in the path of an include or include?
+func (d *document) completions(line, char int) []completionItem {
+	if line < 0 || line >= len(d.lines) {
+		return nil
+	}
+	text := d.lines[line]
+	prefix := text[:byteOffset(text, char)]
+	if strings.HasPrefix(strings.TrimLeft(prefix, "\t"), "#") {
+		return nil // comment
+	}
+
+	def, inBody := d.defineAt(line)
+	if !inBody {
+		for _, keyword := range []string{"include ", "include? "} {
+			if rest, ok := strings.CutPrefix(prefix, keyword); ok {
+				p := strings.TrimLeft(rest, " \t")
+				if strings.ContainsAny(p, " \t") {
+					return nil
+				}
+				return d.includeCompletions(line, char, p)
+			}
+		}
+	}
+
+	if name := strings.TrimLeft(prefix, "\t"); !strings.ContainsAny(name, " \t$") {
+		// A command name, at the start of a line or of a body line.
+		if indented := len(name) < len(prefix); indented != inBody {
+			return nil
+		}
+		return d.templateCompletions(span{line, char - utf16Len(name), line, char})
+	}
+	if !inBody {
+		return nil
+	}
+	// A parameter reference; the completion replaces the whole name.
+	after := text[len(prefix):]
+	i, j := len(prefix), 0
+	for i > 0 && isRefByte(prefix[i-1]) {
+		i--
+	}
+	for j < len(after) && isRefByte(after[j]) {
+		j++
+	}
+	word, rest := prefix[i:], after[:j]
+	s := span{line, char - utf16Len(word), line, char + utf16Len(rest)}
+	switch before := prefix[:len(prefix)-len(word)]; {
+	case strings.HasSuffix(before, "${") && !escaped(before[:len(before)-1]):
+		closing := "}"
+		if strings.HasPrefix(after[len(rest):], "}") {
+			closing = ""
+		}
+		return paramCompletions(def, s, closing)
+	case strings.HasSuffix(before, "$") && !escaped(before):
+		return paramCompletions(def, s, "")
+	}
+	return nil
+}
+
+// defineAt returns the define expression whose body contains line, if any.
+func (d *document) defineAt(line int) (exprInfo, bool) {
+	for _, info := range d.exprs {
+		if info.expr.Name != "define" || line <= info.line {
+			continue
+		}
+		if s := toSpan(d.lines, info.expr.Span); line <= s.endLine {
+			return info, true
+		}
+	}
+	return exprInfo{}, false
+}
+
+// isRefByte reports whether c can be part of the name in a parameter
+// reference, such as "title?" or "hosts...".
+func isRefByte(c byte) bool {
+	return isIdentContinue(c) || c == '?' || c == '.'
+}
+
+// escaped reports whether the $ ending s is part of a $$ escape rather than
+// the start of a parameter reference.
+func escaped(s string) bool {
+	n := len(s) - len(strings.TrimRight(s, "$"))
+	return n%2 == 0
+}
+
+// templateCompletions returns the templates visible in the document, to
+// replace the text in s. Each inserts a snippet with a placeholder for each
+// required parameter.
+func (d *document) templateCompletions(s span) []completionItem {
+	var items []completionItem
+	for _, name := range slices.Sorted(maps.Keys(d.defs)) {
+		def := d.defs[name]
+		snippet := snippetEscape(name)
+		n := 0
+		for _, p := range def.params {
+			if p.optional() || p.variadic() {
+				continue
+			}
+			n++
+			snippet += " ${" + strconv.Itoa(n) + ":" + snippetEscape(p.name()) + "}"
+		}
+		item := completionItem{
+			Label:            name,
+			Kind:             kindFunction,
+			Detail:           signature(name, def.params),
+			InsertTextFormat: formatSnippet,
+			TextEdit:         textEdit{s.toLSP(), snippet},
+		}
+		if def.doc != "" {
+			item.Documentation = &markupContent{Kind: "markdown", Value: def.doc}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// paramCompletions returns the parameters of the template defined by def,
+// to replace the text in s followed by closing. A variadic parameter is
+// offered both as the list and as its elements.
+func paramCompletions(def exprInfo, s span, closing string) []completionItem {
+	header, _, _ := strings.Cut(def.expr.Body, "\n")
+	fields := strings.Fields(header)
+	if len(fields) == 0 {
+		return nil
+	}
+	var names []string
+	for _, p := range parseParams(fields[1:]) {
+		if p.variadic() {
+			names = append(names, strings.TrimSuffix(p.name(), "..."))
+		}
+		names = append(names, p.name())
+	}
+	items := make([]completionItem, len(names))
+	for i, name := range names {
+		items[i] = completionItem{
+			Label:    name,
+			Kind:     kindVariable,
+			Detail:   "parameter of " + fields[0],
+			TextEdit: textEdit{s.toLSP(), name + closing},
+		}
+	}
+	return items
+}
+
+// includeCompletions returns the files that can complete the include path
+// p, which ends at the given position: the .linebased files, without their
+// extension, and the directories in the directory of p, looked up in the
+// root and the search path.
+func (d *document) includeCompletions(line, char int, p string) []completionItem {
+	r, ok := d.resolver.(*fileResolver)
+	if !ok {
+		return nil
+	}
+	dir, _ := path.Split(p)
+	s := span{line, char - utf16Len(p), line, char}
+	var items []completionItem
+	for _, e := range r.readDir(strings.TrimSuffix(dir, "/")) {
+		name := e.Name()
+		switch {
+		case strings.HasPrefix(name, "."):
+			continue
+		case e.IsDir():
+			items = append(items, completionItem{
+				Label:    name + "/",
+				Kind:     kindFolder,
+				TextEdit: textEdit{s.toLSP(), dir + name + "/"},
+			})
+		case strings.HasSuffix(name, ".linebased"):
+			if path.Join(r.root, dir, name) == d.source {
+				continue
+			}
+			name = strings.TrimSuffix(name, ".linebased")
+			items = append(items, completionItem{
+				Label:    name,
+				Kind:     kindFile,
+				TextEdit: textEdit{s.toLSP(), dir + name},
+			})
+		}
+	}
+	return items
+}
+
+// readDir returns the entries of dir, a slash-separated path relative to
+// the include root, in the root and in each directory of the search path.
+// Of entries with the same name, the first is kept, as Resolve would find
+// it. The entries are sorted by name.
+func (r *fileResolver) readDir(dir string) []fs.DirEntry {
+	if dir == "" {
+		dir = "."
+	}
+	if !fs.ValidPath(dir) {
+		return nil
+	}
+	var all []fs.DirEntry
+	seen := make(map[string]bool)
+	for i, root := range append([]string{r.root}, r.path...) {
+		var entries []fs.DirEntry
+		if i == 0 && r.fsys != nil {
+			entries, _ = fs.ReadDir(r.fsys, dir)
+		} else {
+			entries, _ = os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+		}
+		for _, e := range entries {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				all = append(all, e)
+			}
+		}
+	}
+	slices.SortFunc(all, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return all
+}
+
+// snippetEscape escapes the characters of s that are special in snippets.
+func snippetEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `$`, `\$`, `}`, `\}`).Replace(s)
+}
+
+// byteOffset returns the byte offset in s of the position char, counted in
+// UTF-16 code units, clamped to the length of s.
+func byteOffset(s string, char int) int {
+	n := 0
+	for i, r := range s {
+		if n >= char {
+			return i
+		}
+		n++
+		if r > 0xFFFF {
+			n++
+		}
+	}
+	return len(s)
+}
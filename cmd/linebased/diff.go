@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+type diffOp struct {
+	kind   byte // ' ', '-', or '+'
+	text   string
+	ai, bi int // lines of old and new before this op
+}
+
+// unifiedDiff returns a unified diff from old to new, or nil if they are
+// equal. Files are compared line by line using their longest common
+// subsequence.
+func unifiedDiff(oldName, newName string, old, new []byte) []byte {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	d := &differ{a: diffLines(old), b: diffLines(new)}
+	d.diff(0, len(d.a), 0, len(d.b))
+	ops := d.ops
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "diff %s %s\n--- %s\n+++ %s\n", oldName, newName, oldName, newName)
+	for k := 0; k < len(ops); {
+		for k < len(ops) && ops[k].kind == ' ' {
+			k++
+		}
+		if k == len(ops) {
+			break
+		}
+
+		// Extend the hunk over changes separated by little context.
+		start, end := max(0, k-diffContext), k
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			r := end
+			for r < len(ops) && ops[r].kind == ' ' {
+				r++
+			}
+			if r == len(ops) || r-end > 2*diffContext {
+				end = min(r, end+diffContext)
+				break
+			}
+			end = r
+		}
+
+		hunk := ops[start:end]
+		var na, nb int
+		for _, op := range hunk {
+			if op.kind != '+' {
+				na++
+			}
+			if op.kind != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(hunk[0].ai, na), hunkRange(hunk[0].bi, nb))
+		for _, op := range hunk {
+			out.WriteByte(op.kind)
+			out.WriteString(op.text)
+			if !strings.HasSuffix(op.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return out.Bytes()
+}
+
+// A differ computes the operations that turn the lines a into the lines b.
+type differ struct {
+	a, b []string
+	ops  []diffOp
+	i, j int // lines of a and b before the next op
+}
+
+func (d *differ) emit(kind byte, text string) {
+	d.ops = append(d.ops, diffOp{kind, text, d.i, d.j})
+	if kind != '+' {
+		d.i++
+	}
+	if kind != '-' {
+		d.j++
+	}
+}
+
+// diff appends the operations turning a[a0:a1] into b[b0:b1]. It uses
+// Hirschberg's algorithm, which finds a longest common subsequence in
+// space linear in the length of the input: the middle line of a is matched
+// to the position in b that splits the subsequence, and each half is
+// diffed in turn.
+func (d *differ) diff(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.emit(' ', d.a[a0])
+		a0++
+		b0++
+	}
+	n := 0 // length of the common suffix
+	for a0 < a1-n && b0 < b1-n && d.a[a1-n-1] == d.b[b1-n-1] {
+		n++
+	}
+	a1, b1 = a1-n, b1-n
+	defer func() {
+		for k := range n {
+			d.emit(' ', d.a[a1+k])
+		}
+	}()
+
+	switch {
+	case a0 == a1:
+		for _, line := range d.b[b0:b1] {
+			d.emit('+', line)
+		}
+		return
+	case b0 == b1 || a1-a0 == 1:
+		// A single line of a is kept if b has it.
+		if a1-a0 == 1 {
+			if k := slices.Index(d.b[b0:b1], d.a[a0]); k >= 0 {
+				for _, line := range d.b[b0 : b0+k] {
+					d.emit('+', line)
+				}
+				d.emit(' ', d.a[a0])
+				for _, line := range d.b[b0+k+1 : b1] {
+					d.emit('+', line)
+				}
+				return
+			}
+		}
+		for _, line := range d.a[a0:a1] {
+			d.emit('-', line)
+		}
+		for _, line := range d.b[b0:b1] {
+			d.emit('+', line)
+		}
+		return
+	}
+
+	mid := (a0 + a1) / 2
+	fwd := lcsLengths(d.a[a0:mid], d.b[b0:b1], false)
+	rev := lcsLengths(d.a[mid:a1], d.b[b0:b1], true)
+	k, best := 0, -1
+	for i := range fwd {
+		if n := fwd[i] + rev[len(rev)-1-i]; n > best {
+			k, best = i, n
+		}
+	}
+	d.diff(a0, mid, b0, b0+k)
+	d.diff(mid, a1, b0+k, b1)
+}
+
+// lcsLengths returns the lengths of the longest common subsequences of a
+// and each prefix of b, b[:0] through b[:len(b)]. If reverse is set, it
+// compares a and b read backwards, so the lengths are for the suffixes of
+// b, b[len(b):] through b[0:].
+func lcsLengths(a, b []string, reverse bool) []int {
+	at := func(s []string, i int) string {
+		if reverse {
+			return s[len(s)-1-i]
+		}
+		return s[i]
+	}
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if at(a, i) == at(b, j) {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(cur[j], prev[j+1])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// hunkRange formats the range of a hunk starting after line start.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// diffLines splits b into lines, keeping their terminators.
+func diffLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -9,7 +9,9 @@ The commands are:
 
 	agents      print guidance for coding agents
 	expand      expand templates and includes
+	fmt         format linebased files
 	lsp         start the language server
+	vet         report problems in linebased files
 
 Use "linebased help <command>" for more information about a command.
 */
@@ -17,6 +19,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"cmp"
 	_ "embed"
 	"encoding/json"
@@ -25,6 +28,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"net/url"
 	"os"
 	"path"
@@ -36,6 +40,7 @@ import (
 	"unicode"
 
 	"blake.io/linebased"
+	"blake.io/linebased/cst"
 )
 
 //go:embed agents.md
@@ -59,7 +64,9 @@ Usage:
 The commands are:
 
 	expand      expand templates and includes
+	fmt         format linebased files
 	lsp         start the language server
+	vet         report problems in linebased files
 	agents      print guidance for coding agents
 
 Use "linebased <command> -h" for more information about a command.
@@ -77,6 +84,10 @@ Use "linebased <command> -h" for more information about a command.
 		runAgents(flag.Args()[1:])
 	case "expand":
 		runExpand(flag.Args()[1:])
+	case "fmt":
+		runFmt(flag.Args()[1:])
+	case "vet":
+		runVet(flag.Args()[1:])
 	case "lsp":
 		runLSP(flag.Args()[1:])
 	default:
@@ -152,10 +163,19 @@ See the plugin documentation for key mappings and configuration:
 func runExpand(args []string) {
 	fs := flag.NewFlagSet("expand", flag.ExitOnError)
 	fs.Usage = func() {
-		fmt.Fprint(os.Stderr, `Usage: linebased expand [-x] [-l] <file>
+		fmt.Fprint(os.Stderr, `Usage: linebased expand [-x] [-l] [-json] <file>
 
 Expand outputs a linebased file with all templates expanded and includes
-resolved.
+resolved. Includes are found in the directory of the file or, failing that,
+in the directories listed in $LINEBASEDPATH, in order.
+
+With -json, expand writes each expanded expression as a JSON object on its
+own line, with its call stack and the arguments of each call:
+
+	{"name":"echo","body":"hi\n","file":"script.linebased","line":2,
+	 "where":"script.linebased:5: greet@2","stack":[{"name":"greet",
+	 "args":["hi"],"file":"script.linebased","line":5,
+	 "where":"script.linebased:5: main@5"}]}
 
 Flags:
 `)
@@ -163,6 +183,7 @@ Flags:
 	}
 	trace := fs.Bool("x", false, "trace template expansion to stderr")
 	fullpath := fs.Bool("l", false, "prefix output with file:line: locations")
+	jsonOut := fs.Bool("json", false, "print one JSON object per expanded expression")
 	fs.Parse(args)
 
 	if fs.NArg() == 0 {
@@ -174,6 +195,8 @@ Flags:
 	// Track last traced stack to avoid duplicate trace lines
 	var lastStack []linebased.Expanded
 
+	enc := json.NewEncoder(os.Stdout)
+
 	// Get absolute path and directory for the filesystem root
 	absPath, err := filepath.Abs(filename)
 	if err != nil {
@@ -185,6 +208,7 @@ Flags:
 
 	fsys := os.DirFS(dir)
 	dec := linebased.NewExpandingDecoder(base, fsys)
+	setIncludePath(dec)
 
 	// For fullpath mode, use absolute paths in output
 	if *fullpath {
@@ -201,6 +225,14 @@ Flags:
 			os.Exit(1)
 		}
 
+		if *jsonOut {
+			if err := enc.Encode(newExpandedJSON(expr)); err != nil {
+				fmt.Fprintf(os.Stderr, "linebased expand: %v\n", err)
+				os.Exit(1)
+			}
+			continue
+		}
+
 		// Output comment if present
 		if expr.Comment != "" {
 			if *fullpath {
@@ -233,12 +265,299 @@ Flags:
 	}
 }
 
+func runFmt(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage: linebased fmt [-l] [-d] [-w] [path ...]
+
+Fmt formats linebased files. Without paths, it formats standard input.
+Directories are walked for files with the .linebased extension.
+
+By default, fmt prints the formatted source to standard output.
+
+Flags:
+`)
+		flags.PrintDefaults()
+	}
+	var opts fmtOptions
+	flags.BoolVar(&opts.list, "l", false, "list files whose formatting differs")
+	flags.BoolVar(&opts.diff, "d", false, "display diffs instead of rewriting files")
+	flags.BoolVar(&opts.write, "w", false, "write result to source file instead of standard output")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if opts.write {
+			fmt.Fprintln(os.Stderr, "linebased fmt: cannot use -w with standard input")
+			os.Exit(1)
+		}
+		src, err := io.ReadAll(os.Stdin)
+		if err == nil {
+			err = formatFile("<standard input>", src, os.Stdout, opts)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "linebased fmt: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ok := walkFiles("fmt", flags.Args(), func(name string) error {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return formatFile(name, src, os.Stdout, opts)
+	})
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// walkFiles calls fn for each named file and for each .linebased file
+// within the named directories. It reports errors to standard error and
+// returns whether there were none.
+func walkFiles(cmd string, paths []string, fn func(name string) error) bool {
+	ok := true
+	report := func(err error) {
+		fmt.Fprintf(os.Stderr, "linebased %s: %v\n", cmd, err)
+		ok = false
+	}
+	for _, arg := range paths {
+		err := filepath.WalkDir(arg, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || (name != arg && filepath.Ext(name) != ".linebased") {
+				return nil
+			}
+			if err := fn(name); err != nil {
+				report(err)
+			}
+			return nil
+		})
+		if err != nil {
+			report(err)
+		}
+	}
+	return ok
+}
+
+func runVet(args []string) {
+	flags := flag.NewFlagSet("vet", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, `Usage: linebased vet [-json] [path ...]
+
+Vet reports problems in linebased files: syntax errors, misordered optional
+parameters, templates used before their definition, calls with too few
+arguments, and errors from expanding each file. Without paths, it checks the
+current directory. Directories are walked for files with the .linebased
+extension. Includes are found as expand finds them, using $LINEBASEDPATH.
+
+Vet exits with a non-zero status if it finds any problems.
+
+Flags:
+`)
+		flags.PrintDefaults()
+	}
+	jsonOut := flags.Bool("json", false, "print findings as a JSON array")
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var findings []finding
+	ok := walkFiles("vet", paths, func(name string) error {
+		found, err := vetFile(name)
+		findings = append(findings, found...)
+		return err
+	})
+
+	if *jsonOut {
+		if findings == nil {
+			findings = []finding{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(findings)
+	} else {
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+	}
+	if !ok || len(findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// finding is a problem reported by vet.
+type finding struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"` // 1-indexed; 0 if unknown
+	Message string `json:"message"`
+}
+
+func (f finding) String() string {
+	if f.Line == 0 {
+		return fmt.Sprintf("%s: %s", f.File, f.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", f.File, f.Line, f.Message)
+}
+
+// vetFile returns the problems in the named file, ordered by position: the
+// diagnostics the language server reports for it, and the errors from
+// expanding it, except on lines a diagnostic already covers.
+func vetFile(name string) ([]finding, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+
+	var findings []finding
+	doc := newDocument("file://"+filepath.ToSlash(abs), string(src))
+	for _, e := range doc.errors {
+		findings = append(findings, finding{name, e.line + 1, e.msg})
+	}
+
+	// Included files are identified by the paths they are read from, which
+	// may be in $LINEBASEDPATH, to report errors in them.
+	dir := filepath.Dir(abs)
+	d := linebased.NewExpandingDecoder(filepath.Base(abs), os.DirFS(dir))
+	d.SetResolver(&fileResolver{root: dir, path: searchPath()})
+	d.SetRecover(true)
+	var errs []error
+	for {
+		_, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var list linebased.ErrorList
+			if !errors.As(err, &list) {
+				list = linebased.ErrorList{err}
+			}
+			errs = list
+			break
+		}
+	}
+	for _, err := range errs {
+		f := finding{File: name, Message: err.Error()}
+		var exprErr *linebased.ExpressionError
+		if errors.As(err, &exprErr) {
+			// Report template errors at the call in a real file.
+			site := exprErr.Expanded
+			if len(site.Stack) > 0 {
+				site = site.Stack[0]
+			}
+			if site.File != "" && site.File != filepath.Base(abs) {
+				f.File = filepath.FromSlash(site.File)
+				if rel, err := filepath.Rel(dir, f.File); err == nil && filepath.IsLocal(rel) {
+					f.File = filepath.Join(filepath.Dir(name), rel)
+				}
+			}
+			f.Line = site.Line
+			f.Message = exprErr.Err.Error()
+		}
+		if !slices.ContainsFunc(findings, func(g finding) bool { return g.File == f.File && g.Line == f.Line }) {
+			findings = append(findings, f)
+		}
+	}
+	slices.SortStableFunc(findings, func(a, b finding) int {
+		return cmp.Or(cmp.Compare(a.File, b.File), cmp.Compare(a.Line, b.Line))
+	})
+	return findings, nil
+}
+
+type fmtOptions struct {
+	list  bool // print names of files whose formatting differs
+	diff  bool // print diffs
+	write bool // rewrite files in place
+}
+
+// formatFile formats src, read from the named file, and reports the
+// result to out as directed by opts.
+func formatFile(name string, src []byte, out io.Writer, opts fmtOptions) error {
+	res, err := linebased.Format(src)
+	if err != nil {
+		return fmt.Errorf("%s:%w", name, err)
+	}
+	if !bytes.Equal(src, res) {
+		if opts.list {
+			fmt.Fprintln(out, name)
+		}
+		if opts.write {
+			info, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(name, res, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		if opts.diff {
+			out.Write(unifiedDiff(name+".orig", name, src, res))
+		}
+	}
+	if !opts.list && !opts.write && !opts.diff {
+		_, err = out.Write(res)
+	}
+	return err
+}
+
+// expandedJSON is the form of an expanded expression printed by expand -json.
+type expandedJSON struct {
+	Name    string      `json:"name"`
+	Body    string      `json:"body"`
+	Comment string      `json:"comment,omitempty"`
+	File    string      `json:"file"`
+	Line    int         `json:"line"`
+	Where   string      `json:"where"`
+	Stack   []frameJSON `json:"stack"`
+}
+
+// frameJSON is a template call in the stack of an expandedJSON.
+type frameJSON struct {
+	Name  string   `json:"name"`
+	Args  []string `json:"args"`
+	File  string   `json:"file"`
+	Line  int      `json:"line"`
+	Where string   `json:"where"`
+}
+
+func newExpandedJSON(expr linebased.Expanded) expandedJSON {
+	v := expandedJSON{
+		Name:    expr.Name,
+		Body:    expr.Body,
+		Comment: expr.Comment,
+		File:    expr.File,
+		Line:    expr.Line,
+		Where:   expr.Where(),
+		Stack:   make([]frameJSON, len(expr.Stack)),
+	}
+	for i, frame := range expr.Stack {
+		v.Stack[i] = frameJSON{
+			Name:  frame.Name,
+			Args:  append([]string{}, frame.Args...),
+			File:  frame.File,
+			Line:  frame.Line,
+			Where: frame.Where(),
+		}
+	}
+	return v
+}
+
 // Server
 
 type server struct {
 	r        *bufio.Reader
 	w        *bufio.Writer
 	docs     map[string]*document
+	roots    []string // workspace folders, searched by workspace/symbol
 	shutdown bool
 }
 
@@ -294,6 +613,14 @@ func (s *server) dispatch(msg *request) error {
 		return s.handleRename(msg)
 	case "textDocument/semanticTokens/full":
 		return s.handleSemanticTokens(msg)
+	case "textDocument/completion":
+		return s.handleCompletion(msg)
+	case "textDocument/signatureHelp":
+		return s.handleSignatureHelp(msg)
+	case "textDocument/documentSymbol":
+		return s.handleDocumentSymbol(msg)
+	case "workspace/symbol":
+		return s.handleWorkspaceSymbol(msg)
 	case "$/cancelRequest", "workspace/didChangeConfiguration":
 		return nil
 	default:
@@ -307,6 +634,22 @@ func (s *server) dispatch(msg *request) error {
 // Handlers
 
 func (s *server) handleInitialize(msg *request) error {
+	var p struct {
+		RootURI          string `json:"rootUri"`
+		WorkspaceFolders []struct {
+			URI string `json:"uri"`
+		} `json:"workspaceFolders"`
+	}
+	json.Unmarshal(msg.Params, &p) // the workspace is optional
+	for _, folder := range p.WorkspaceFolders {
+		if dir, ok := uriPath(folder.URI); ok {
+			s.roots = append(s.roots, dir)
+		}
+	}
+	if dir, ok := uriPath(p.RootURI); ok && len(s.roots) == 0 {
+		s.roots = append(s.roots, dir)
+	}
+
 	// Static response - capabilities don't change
 	// Token types:
 	//   string - template body lines
@@ -319,6 +662,10 @@ func (s *server) handleInitialize(msg *request) error {
 			"definitionProvider": true,
 			"codeActionProvider": true,
 			"renameProvider": true,
+			"completionProvider": {"triggerCharacters": ["$", "{", "/"]},
+			"signatureHelpProvider": {"triggerCharacters": [" "], "retriggerCharacters": [" "]},
+			"documentSymbolProvider": true,
+			"workspaceSymbolProvider": true,
 			"semanticTokensProvider": {
 				"legend": {"tokenTypes": ["comment", "keyword", "function", "string", "parameter", "variable"], "tokenModifiers": []},
 				"full": true
@@ -351,9 +698,12 @@ func (s *server) handleDidOpen(msg *request) error {
 	if err := json.Unmarshal(msg.Params, &p); err != nil {
 		return nil
 	}
-	doc := newDocument(p.TextDocument.URI, p.TextDocument.Text)
+	doc := newDocumentOverlay(p.TextDocument.URI, p.TextDocument.Text, nil, s.docs)
 	s.docs[p.TextDocument.URI] = doc
-	return s.publishDiagnostics(doc)
+	if err := s.publishDiagnostics(doc); err != nil {
+		return err
+	}
+	return s.reparseDependents(doc)
 }
 
 func (s *server) handleDidChange(msg *request) error {
@@ -371,7 +721,10 @@ func (s *server) handleDidChange(msg *request) error {
 		return nil
 	}
 	doc.setText(p.ContentChanges[len(p.ContentChanges)-1].Text)
-	return s.publishDiagnostics(doc)
+	if err := s.publishDiagnostics(doc); err != nil {
+		return err
+	}
+	return s.reparseDependents(doc)
 }
 
 func (s *server) handleDidClose(msg *request) error {
@@ -381,7 +734,29 @@ func (s *server) handleDidClose(msg *request) error {
 	if err := json.Unmarshal(msg.Params, &p); err != nil {
 		return nil
 	}
+	doc := s.docs[p.TextDocument.URI]
+	if doc == nil {
+		return nil
+	}
 	delete(s.docs, p.TextDocument.URI)
+	// Dependents read the file from disk again.
+	return s.reparseDependents(doc)
+}
+
+// reparseDependents reparses the open documents that include doc, directly
+// or not, so that they see its current text, and publishes their
+// diagnostics.
+func (s *server) reparseDependents(doc *document) error {
+	for _, uri := range slices.Sorted(maps.Keys(s.docs)) {
+		other := s.docs[uri]
+		if other == doc || !other.files[doc.source] {
+			continue
+		}
+		other.parse()
+		if err := s.publishDiagnostics(other); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -400,6 +775,19 @@ func (s *server) handleHover(msg *request) error {
 	if doc == nil {
 		return s.reply(msg.ID, nil)
 	}
+
+	// Show where an include path leads
+	if includePath, rng, ok := doc.includePathAt(p.Position.Line, p.Position.Character); ok {
+		info, _ := doc.exprAt(p.Position.Line)
+		return s.reply(msg.ID, struct {
+			Contents markupContent `json:"contents"`
+			Range    lspRange      `json:"range"`
+		}{
+			Contents: markupContent{Kind: "markdown", Value: doc.includeHover(info.expr.Name, includePath)},
+			Range:    rng.toLSP(),
+		})
+	}
+
 	name, rng, ok := doc.symbolAt(p.Position.Line, p.Position.Character)
 	if !ok {
 		return s.reply(msg.ID, nil)
@@ -418,17 +806,7 @@ func (s *server) handleHover(msg *request) error {
 
 	// Show signature
 	content.WriteString("```linebased\n")
-	content.WriteString(name)
-	for _, param := range def.params {
-		content.WriteString(" ")
-		if param.optional() {
-			content.WriteString("[")
-			content.WriteString(string(param))
-			content.WriteString("]")
-		} else {
-			content.WriteString(string(param))
-		}
-	}
+	content.WriteString(signature(name, def.params))
 	content.WriteString("\n```")
 
 	// If this is a call site (not a definition), show expansion
@@ -473,9 +851,13 @@ func (s *server) handleDefinition(msg *request) error {
 	}
 
 	// Check if cursor is on an include path
-	if includePath, ok := doc.includePathAt(p.Position.Line, p.Position.Character); ok {
-		// Include paths are rooted at doc.root with .linebased extension added
-		absolutePath := path.Join(doc.root, includePath+".linebased")
+	if includePath, _, ok := doc.includePathAt(p.Position.Line, p.Position.Character); ok {
+		// Include paths are rooted at doc.root, or a directory of the
+		// search path, with .linebased extension added.
+		absolutePath, ok := doc.resolveInclude(includePath)
+		if !ok {
+			absolutePath = path.Join(doc.root, includePath+".linebased")
+		}
 		includeURI := "file://" + absolutePath
 		return s.reply(msg.ID, location{
 			URI:   includeURI,
@@ -491,12 +873,10 @@ func (s *server) handleDefinition(msg *request) error {
 	if !ok {
 		return s.reply(msg.ID, nil)
 	}
-	// Definition location: after "define " on the definition line
-	start := utf16Len("define ")
 	length := utf16Len(name)
 	return s.reply(msg.ID, location{
 		URI:   def.uri,
-		Range: span{def.line, start, def.line, start + length}.toLSP(),
+		Range: span{def.line, def.char, def.line, def.char + length}.toLSP(),
 	})
 }
 
@@ -823,21 +1203,25 @@ type document struct {
 	lines        []string
 	exprs        []exprInfo
 	defs         map[string]definition
+	privates     map[string]string // private templates of included files, to the path of the first file defining them
 	errors       []diagError
-	fsys         fs.FS                 // filesystem for resolving includes (nil uses os.DirFS(root))
+	resolver     linebased.Resolver    // finds included files; see fileResolver
+	files        map[string]bool       // absolute paths of the files read by parse, including this one
 	includedExpr map[string][]exprInfo // expressions from included files, keyed by URI
 }
 
 type exprInfo struct {
 	expr        linebased.Expression
 	line        int            // 0-indexed
+	nameSpan    span           // range of the command name
 	definedName string         // for define expressions, the template name
+	definedSpan span           // range of definedName
 	bodyExprs   []bodyExprInfo // expressions within a define body
 }
 
 type bodyExprInfo struct {
 	name string // command name
-	line int    // 0-indexed document line
+	span span   // range of the name in the document
 }
 
 type definition struct {
@@ -846,6 +1230,7 @@ type definition struct {
 	params params // parameter names
 	body   string // template body (for expansion preview)
 	line   int    // 0-indexed line of definition
+	char   int    // 0-indexed start of the template name on line
 }
 
 type diagError struct {
@@ -862,16 +1247,33 @@ func (s span) toLSP() lspRange {
 	}
 }
 
+// contains reports whether the single-line span s contains the position.
+func (s span) contains(line, char int) bool {
+	return line == s.startLine && char >= s.startChar && char < s.endChar
+}
+
+// token returns a semantic token covering the single-line span s.
+func (s span) token(typ int) semToken {
+	return semToken{s.startLine, s.startChar, s.endChar - s.startChar, typ}
+}
+
 func newDocument(uri, text string) *document {
 	return newDocumentFS(uri, text, nil)
 }
 
+// newDocumentFS returns a document whose includes are read from fsys, which
+// is rooted at the directory of the document. A nil fsys reads them from the
+// operating system.
 func newDocumentFS(uri, text string, fsys fs.FS) *document {
+	return newDocumentOverlay(uri, text, fsys, nil)
+}
+
+// newDocumentOverlay is like newDocumentFS, but included files open in the
+// editor, found in overlay by URI, are read from their current text.
+func newDocumentOverlay(uri, text string, fsys fs.FS, overlay map[string]*document) *document {
 	source := uri
-	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
-		if p, err := url.PathUnescape(u.Path); err == nil && p != "" {
-			source = p
-		}
+	if p, ok := uriPath(uri); ok {
+		source = p
 	}
 	// Root is the directory containing the main file.
 	// All include paths are relative to this root.
@@ -882,34 +1284,61 @@ func newDocumentFS(uri, text string, fsys fs.FS) *document {
 		root:         root,
 		text:         text,
 		defs:         make(map[string]definition),
-		fsys:         fsys,
+		privates:     make(map[string]string),
 		includedExpr: make(map[string][]exprInfo),
 	}
+	d.resolver = &fileResolver{
+		root:    root,
+		fsys:    fsys,
+		path:    searchPath(),
+		overlay: overlay,
+	}
 	d.parse()
 	return d
 }
 
+// uriPath returns the path of the file named by a file URI.
+func uriPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	p, err := url.PathUnescape(u.Path)
+	if err != nil || p == "" {
+		return "", false
+	}
+	return p, true
+}
+
 func (d *document) setText(text string) {
 	d.text = text
 	d.parse()
 }
 
 func (d *document) parse() {
-	d.lines = strings.Split(strings.ReplaceAll(d.text, "\r\n", "\n"), "\n")
+	d.lines = splitLines(d.text)
 	d.exprs = d.exprs[:0]
 	d.errors = d.errors[:0]
 	clear(d.defs)
+	clear(d.privates)
 	clear(d.includedExpr)
 
-	d.parseFile(d.uri, d.source, d.text, nil)
+	d.files = make(map[string]bool)
+	d.parseFile(d.uri, d.source, d.text, d.files)
 
 	// Check argument counts and forward references (only for expressions in main file)
 	for _, info := range d.exprs {
-		if info.expr.Name == "" || info.expr.Name == "define" || info.expr.Name == "include" {
+		if info.expr.Name == "" || info.expr.Name == "define" || isInclude(info.expr.Name) {
 			continue
 		}
 		def, ok := d.defs[info.expr.Name]
 		if !ok {
+			if file, ok := d.privates[info.expr.Name]; ok {
+				d.errors = append(d.errors, diagError{
+					line: info.line,
+					msg:  fmt.Sprintf("template %q is private to %s", info.expr.Name, d.relFile(file)),
+				})
+			}
 			continue
 		}
 		// Only check forward references for definitions in the same file
@@ -942,49 +1371,44 @@ func (d *document) parseFile(uri, source, text string, seen map[string]bool) {
 	}
 	seen[source] = true
 
-	dec := linebased.NewDecoder(strings.NewReader(text))
-	for {
-		expr, err := dec.Decode()
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
+	file, _ := cst.Parse([]byte(text))
+	lines := splitLines(text)
+	for _, node := range file.Exprs {
+		if node.Err != nil {
+			// Only report errors for the main document
 			var synErr *linebased.SyntaxError
-			if errors.As(err, &synErr) {
-				// Only report errors for the main document
-				if uri == d.uri {
-					d.errors = append(d.errors, diagError{synErr.Line - 1, synErr.Message})
-				}
+			if uri == d.uri && errors.As(node.Err, &synErr) {
+				d.errors = append(d.errors, diagError{synErr.Line - 1, synErr.Message})
 			}
 			continue
 		}
+		expr := node.Expression()
 
 		// Track expressions for main document and included files
-		info := exprInfo{expr: expr, line: expr.Line - 1}
+		info := exprInfo{
+			expr:     expr,
+			line:     expr.Line - 1,
+			nameSpan: toSpan(lines, expr.NameSpan),
+		}
 		if expr.Name == "define" {
-			header, bodyText, _ := strings.Cut(expr.Body, "\n")
+			header, _, _ := strings.Cut(expr.Body, "\n")
 			fields := strings.Fields(header)
 			if len(fields) > 0 {
 				info.definedName = fields[0]
+				info.definedSpan = toSpan(lines, prefixSpan(expr.TailSpan, len(fields[0])))
 			}
-			// Parse body expressions for context help
-			if bodyText != "" {
-				bodyDec := linebased.NewDecoder(strings.NewReader(bodyText))
-				for {
-					bodyExpr, err := bodyDec.Decode()
-					if errors.Is(err, io.EOF) {
-						break
-					}
-					if err != nil {
-						break
-					}
-					if bodyExpr.Name != "" {
-						info.bodyExprs = append(info.bodyExprs, bodyExprInfo{
-							name: bodyExpr.Name,
-							line: info.line + bodyExpr.Line, // document line
-						})
-					}
+			// Parse body expressions for context help. Positions in the
+			// nested file refer to the document, past the leading tab.
+			body, _ := node.Nested()
+			for _, bodyNode := range body.Exprs {
+				if bodyNode.Err != nil || bodyNode.Name() == "" {
+					continue
 				}
+				bodyExpr := bodyNode.Expression()
+				info.bodyExprs = append(info.bodyExprs, bodyExprInfo{
+					name: bodyExpr.Name,
+					span: toSpan(lines, bodyExpr.NameSpan),
+				})
 			}
 		}
 		if uri == d.uri {
@@ -999,6 +1423,15 @@ func (d *document) parseFile(uri, source, text string, seen map[string]bool) {
 			if len(fields) > 0 {
 				name := fields[0]
 				params := parseParams(fields[1:])
+				if p, ok := misplacedDefault(params); ok {
+					if uri == d.uri {
+						d.errors = append(d.errors, diagError{
+							line: expr.Line - 1,
+							msg:  fmt.Sprintf("parameter %q has a default value but is not optional", p),
+						})
+					}
+					continue
+				}
 				if required, optional, ok := invalidOptionalOrder(params); ok {
 					if uri == d.uri {
 						d.errors = append(d.errors, diagError{
@@ -1008,99 +1441,240 @@ func (d *document) parseFile(uri, source, text string, seen map[string]bool) {
 					}
 					continue
 				}
+				if variadic, ok := misplacedVariadic(params); ok {
+					if uri == d.uri {
+						d.errors = append(d.errors, diagError{
+							line: expr.Line - 1,
+							msg:  fmt.Sprintf("variadic parameter %q must be last", variadic),
+						})
+					}
+					continue
+				}
+				// Private templates of included files are not visible
+				// in the document, but are recorded to report calls.
+				if isPrivate(name) && uri != d.uri {
+					if _, exists := d.privates[name]; !exists {
+						d.privates[name] = source
+					}
+					continue
+				}
 				if _, exists := d.defs[name]; !exists {
 					d.defs[name] = definition{
 						uri:    uri,
 						doc:    formatComment(expr.Comment),
 						params: params,
 						body:   body,
-						line:   expr.Line - 1,
+						line:   info.definedSpan.startLine,
+						char:   info.definedSpan.startChar,
 					}
 				}
 			}
-		} else if expr.Name == "include" {
+		} else if isInclude(expr.Name) {
 			includePath, _, _ := strings.Cut(expr.Body, "\n")
 			includePath = strings.TrimSpace(includePath)
-			if includePath != "" {
-				d.processInclude(includePath, seen)
+			if includePath != "" && !validIncludePath(includePath) {
+				if uri == d.uri {
+					d.errors = append(d.errors, diagError{
+						line: expr.Line - 1,
+						msg:  fmt.Sprintf("invalid include path %q", includePath),
+					})
+				}
+				continue
+			}
+			if includePath == "" {
+				continue
+			}
+			err := d.processInclude(includePath, source, seen)
+			// A missing optional include is skipped, as by the decoder.
+			if errors.Is(err, fs.ErrNotExist) && expr.Name == "include" && uri == d.uri {
+				d.errors = append(d.errors, diagError{
+					line: expr.Line - 1,
+					msg:  fmt.Sprintf("cannot find include file %q", includePath+".linebased"),
+				})
 			}
 		}
 	}
 }
 
+// relFile returns file relative to the directory of the document, or file
+// itself if it is outside it.
+func (d *document) relFile(file string) string {
+	if rel, err := filepath.Rel(d.root, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return file
+}
+
+// isPrivate reports whether name is the name of a private template, which
+// is visible only in the file that defines it.
+func isPrivate(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+// isInclude reports whether name is the include builtin or its optional
+// form, include?.
+func isInclude(name string) bool {
+	return name == "include" || name == "include?"
+}
+
 // processInclude reads and parses an included file, adding its definitions
 // to the document's definition map. Include paths are rooted at the document's
-// root directory, matching the behavior of [linebased.ExpandingDecoder].
+// root directory, then at each directory of the search path, matching the
+// behavior of [linebased.ExpandingDecoder]; see fileResolver. The including
+// file is from.
 //
-// For example, if /project/main.lb includes "lib", the decoder opens
-// "lib.linebased" from the root directory /project/.
-func (d *document) processInclude(includePath string, seen map[string]bool) {
-	// Include paths are rooted at d.root with .linebased extension added.
-	// This matches the behavior of linebased.ExpandingDecoder.
-	includePath = includePath + ".linebased"
-	absolutePath := path.Join(d.root, includePath)
-	includeURI := "file://" + absolutePath
-
-	// Read the included file
-	var content []byte
-	var err error
-	if d.fsys != nil {
-		content, err = fs.ReadFile(d.fsys, includePath)
-	} else {
-		content, err = os.ReadFile(absolutePath)
+// For example, if /project/main.lb includes "lib/http", the decoder opens
+// "lib/http.linebased" from the root directory /project/.
+func (d *document) processInclude(includePath, from string, seen map[string]bool) error {
+	file, rc, err := d.resolver.Resolve(includePath+".linebased", from)
+	if err != nil {
+		return err
+	}
+	content, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	d.parseFile("file://"+file, file, string(content), seen)
+	return nil
+}
+
+// resolveInclude returns the absolute path of the file read by
+// "include name" in the document. It reports false if name is not a valid
+// include path or no file is found.
+func (d *document) resolveInclude(name string) (string, bool) {
+	if !validIncludePath(name) {
+		return "", false
 	}
+	file, rc, err := d.resolver.Resolve(name+".linebased", d.source)
 	if err != nil {
-		return // silently ignore missing includes for now
+		return "", false
+	}
+	rc.Close()
+	return file, true
+}
+
+// includeHover returns the hover text for the path of an include or
+// include? statement, naming the file it reads. An optional include of a
+// missing file is described as skipped.
+func (d *document) includeHover(keyword, includePath string) string {
+	file, found := d.resolveInclude(includePath)
+	name := includePath + ".linebased"
+	switch {
+	case keyword == "include?" && found:
+		return fmt.Sprintf("Optionally includes `%s`.", file)
+	case keyword == "include?":
+		return fmt.Sprintf("Optionally includes `%s`, which does not exist; it is skipped.", name)
+	case found:
+		return fmt.Sprintf("Includes `%s`.", file)
+	}
+	return fmt.Sprintf("Includes `%s`, which does not exist.", name)
+}
+
+// A fileResolver resolves the includes of a document as the expand command
+// does, trying root and then each directory of the search path. The
+// identity of a file is its absolute path. Files open in the editor are
+// read from their current text rather than from disk.
+type fileResolver struct {
+	root    string               // directory of the document
+	fsys    fs.FS                // reads root; nil uses the operating system
+	path    []string             // see searchPath
+	overlay map[string]*document // documents open in the editor, keyed by URI
+}
+
+func (r *fileResolver) Resolve(name, from string) (string, io.ReadCloser, error) {
+	var firstErr error
+	for i, dir := range append([]string{r.root}, r.path...) {
+		file := path.Join(filepath.ToSlash(dir), name)
+		for _, doc := range r.overlay {
+			if doc.source == file {
+				return file, io.NopCloser(strings.NewReader(doc.text)), nil
+			}
+		}
+		var content []byte
+		var err error
+		if i == 0 && r.fsys != nil {
+			content, err = fs.ReadFile(r.fsys, name)
+		} else {
+			content, err = os.ReadFile(file)
+		}
+		if err == nil {
+			return file, io.NopCloser(bytes.NewReader(content)), nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", nil, firstErr
+}
+
+// validIncludePath reports whether the decoder accepts name as the path of
+// an include: a slash-separated path without ".", "..", or empty elements,
+// so that it cannot reach outside the include root.
+func validIncludePath(name string) bool {
+	return fs.ValidPath(name) && name != "."
+}
+
+// searchPath returns the absolute paths of the directories listed in
+// $LINEBASEDPATH, a list in the form of $PATH. They are searched in order
+// for included files not found beside the main file.
+func searchPath() []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("LINEBASEDPATH")) {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		dirs = append(dirs, dir)
 	}
+	return dirs
+}
 
-	d.parseFile(includeURI, includePath, string(content), seen)
+// setIncludePath makes d search the directories of $LINEBASEDPATH for
+// included files.
+func setIncludePath(d *linebased.ExpandingDecoder) {
+	var roots []fs.FS
+	for _, dir := range searchPath() {
+		roots = append(roots, os.DirFS(dir))
+	}
+	d.SetIncludePath(roots...)
 }
 
 func (d *document) symbolAt(line, char int) (string, span, bool) {
 	for _, info := range d.exprs {
-		if info.line == line {
-			nameLen := utf16Len(info.expr.Name)
-			if nameLen > 0 && char < nameLen {
-				return info.expr.Name, span{line, 0, line, nameLen}, true
-			}
-			if info.definedName != "" {
-				start := utf16Len(info.expr.Name) + 1
-				length := utf16Len(info.definedName)
-				if char >= start && char < start+length {
-					return info.definedName, span{line, start, line, start + length}, true
-				}
-			}
+		if info.expr.Name != "" && info.nameSpan.contains(line, char) {
+			return info.expr.Name, info.nameSpan, true
+		}
+		if info.definedName != "" && info.definedSpan.contains(line, char) {
+			return info.definedName, info.definedSpan, true
 		}
 		// Check body expressions within defines
 		for _, bodyExpr := range info.bodyExprs {
-			if bodyExpr.line == line {
-				// Body lines have a leading tab, so command starts at char 1
-				nameLen := utf16Len(bodyExpr.name)
-				if char >= 1 && char < 1+nameLen {
-					return bodyExpr.name, span{line, 1, line, 1 + nameLen}, true
-				}
+			if bodyExpr.span.contains(line, char) {
+				return bodyExpr.name, bodyExpr.span, true
 			}
 		}
 	}
 	return "", span{}, false
 }
 
-// includePathAt returns the include path if cursor is on an include statement's path.
-func (d *document) includePathAt(line, char int) (string, bool) {
+// includePathAt returns the include path and its span if cursor is on the
+// path of an include or include? statement.
+func (d *document) includePathAt(line, char int) (string, span, bool) {
 	for _, info := range d.exprs {
-		if info.line != line || info.expr.Name != "include" {
+		if info.line != line || !isInclude(info.expr.Name) {
 			continue
 		}
-		// Include path starts after "include "
-		start := utf16Len("include ")
 		includePath, _, _ := strings.Cut(info.expr.Body, "\n")
 		includePath = strings.TrimSpace(includePath)
-		length := utf16Len(includePath)
-		if char >= start && char < start+length {
-			return includePath, true
+		s := toSpan(d.lines, prefixSpan(info.expr.TailSpan, len(includePath)))
+		if includePath != "" && s.startLine == line && char >= s.startChar && char < s.endChar {
+			return includePath, s, true
 		}
 	}
-	return "", false
+	return "", span{}, false
 }
 
 // exprAt returns the expression info at the given line, if any.
@@ -1114,12 +1688,36 @@ func (d *document) exprAt(line int) (exprInfo, bool) {
 }
 
 func (d *document) exprRange(info exprInfo) lspRange {
-	lastLine := info.line + strings.Count(strings.TrimSuffix(info.expr.Body, "\n"), "\n")
-	lineLen := 0
-	if lastLine >= 0 && lastLine < len(d.lines) {
-		lineLen = utf16Len(d.lines[lastLine])
+	return toSpan(d.lines, info.expr.Span).toLSP()
+}
+
+// splitLines splits text into lines without their terminators.
+func splitLines(text string) []string {
+	return strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+}
+
+// toSpan converts a span of the file with the given lines to LSP
+// positions, counting characters in UTF-16 code units.
+func toSpan(lines []string, s linebased.Span) span {
+	pos := func(p linebased.Pos) (line, char int) {
+		line, char = p.Line-1, p.Column-1
+		if line >= 0 && line < len(lines) {
+			char = utf16Len(lines[line][:min(char, len(lines[line]))])
+		}
+		return line, char
 	}
-	return span{info.line, 0, lastLine, lineLen}.toLSP()
+	var r span
+	r.startLine, r.startChar = pos(s.Start)
+	r.endLine, r.endChar = pos(s.End)
+	return r
+}
+
+// prefixSpan returns the span of the first n bytes of s.
+func prefixSpan(s linebased.Span, n int) linebased.Span {
+	s.End = s.Start
+	s.End.Offset += n
+	s.End.Column += n
+	return s
 }
 
 // expandTrace returns the expanded output for the given template call.
@@ -1127,39 +1725,25 @@ func (d *document) exprRange(info exprInfo) lspRange {
 // then expands it and returns just the expanded expressions (not the call itself).
 func (d *document) expandTrace(name, args string, def definition) string {
 	// Build an in-memory script with the define and a call
-	var script strings.Builder
-	script.WriteString("define ")
-	script.WriteString(name)
+	header := name
 	if len(def.params) > 0 {
-		script.WriteString(" ")
-		script.WriteString(joinParams(def.params))
-	}
-	script.WriteString("\n")
-	if def.body != "" {
-		// Body lines need to be indented with tabs
-		for line := range strings.SplitSeq(def.body, "\n") {
-			if line != "" {
-				script.WriteString("\t")
-				script.WriteString(line)
-				script.WriteString("\n")
-			}
-		}
+		header += " " + joinParams(def.params)
+	}
+	var script strings.Builder
+	enc := linebased.NewEncoder(&script)
+	if err := enc.Encode(linebased.Expression{Name: "define", Body: header + "\n" + def.body}); err != nil {
+		return ""
+	}
+	if err := enc.Encode(linebased.Expression{Name: name, Body: args}); err != nil {
+		return ""
 	}
-	// Add the call.
-	writeLinebasedExpr(&script, name, args)
 
 	// Expand and capture output (just the expanded expressions)
 	fsys := fstest.MapFS{
 		"hover.linebased": &fstest.MapFile{Data: []byte(script.String())},
 	}
-	dec := linebased.NewExpandingDecoder("hover.linebased", fsys)
-
 	var out strings.Builder
-	for {
-		expr, err := dec.Decode()
-		if errors.Is(err, io.EOF) {
-			break
-		}
+	for expr, err := range linebased.Expand("hover.linebased", fsys) {
 		if err != nil {
 			break
 		}
@@ -1172,30 +1756,6 @@ func (d *document) expandTrace(name, args string, def definition) string {
 	return out.String()
 }
 
-func writeLinebasedExpr(b *strings.Builder, name, body string) {
-	b.WriteString(name)
-	body = strings.TrimSuffix(body, "\n")
-	if body == "" {
-		b.WriteString("\n")
-		return
-	}
-
-	head, tail, multiline := strings.Cut(body, "\n")
-	if head != "" {
-		b.WriteByte(' ')
-		b.WriteString(strings.TrimLeftFunc(head, unicode.IsSpace))
-	}
-	b.WriteByte('\n')
-	if !multiline {
-		return
-	}
-	for line := range strings.SplitSeq(tail, "\n") {
-		b.WriteByte('\t')
-		b.WriteString(line)
-		b.WriteByte('\n')
-	}
-}
-
 // refLocation combines a span with a URI for cross-file references.
 type refLocation struct {
 	uri  string
@@ -1209,19 +1769,14 @@ func (d *document) references(name string, includeDecl bool) []refLocation {
 	findRefs := func(uri string, exprs []exprInfo) {
 		for _, info := range exprs {
 			if info.expr.Name == name {
-				nameLen := utf16Len(name)
-				refs = append(refs, refLocation{uri, span{info.line, 0, info.line, nameLen}})
+				refs = append(refs, refLocation{uri, info.nameSpan})
 			} else if includeDecl && info.definedName == name {
-				start := utf16Len(info.expr.Name) + 1
-				length := utf16Len(info.definedName)
-				refs = append(refs, refLocation{uri, span{info.line, start, info.line, start + length}})
+				refs = append(refs, refLocation{uri, info.definedSpan})
 			}
 			// Check body expressions within defines
 			for _, bodyExpr := range info.bodyExprs {
 				if bodyExpr.name == name {
-					nameLen := utf16Len(name)
-					// Body lines have a leading tab, so command starts at char 1
-					refs = append(refs, refLocation{uri, span{bodyExpr.line, 1, bodyExpr.line, 1 + nameLen}})
+					refs = append(refs, refLocation{uri, bodyExpr.span})
 				}
 			}
 		}
@@ -1229,6 +1784,9 @@ func (d *document) references(name string, includeDecl bool) []refLocation {
 
 	// Search main document
 	findRefs(d.uri, d.exprs)
+	if isPrivate(name) {
+		return refs // the same name in other files is another template
+	}
 
 	// Search included files
 	for uri, exprs := range d.includedExpr {
@@ -1263,17 +1821,16 @@ func (d *document) semanticTokens() []uint32 {
 		if info.expr.Name == "" {
 			continue
 		}
-		nameLen := utf16Len(info.expr.Name)
 		typ := tokFunction
-		if info.expr.Name == "define" || info.expr.Name == "include" {
+		if info.expr.Name == "define" || isInclude(info.expr.Name) {
 			typ = tokKeyword
 		}
-		tokens = append(tokens, semToken{info.line, 0, nameLen, typ})
+		tokens = append(tokens, info.nameSpan.token(typ))
 
 		// For define: emit template name, parameters, and parse body as expressions
 		if info.definedName != "" {
-			start := nameLen + 1
-			tokens = append(tokens, semToken{info.line, start, utf16Len(info.definedName), tokFunction})
+			start := info.definedSpan.startChar
+			tokens = append(tokens, info.definedSpan.token(tokFunction))
 			def, defined := d.defs[info.definedName]
 			// Parameters after the template name
 			if defined {
@@ -1290,31 +1847,12 @@ func (d *document) semanticTokens() []uint32 {
 				}
 			}
 
-			// Parse template body as linebased expressions.
-			// The body (after the header line) contains expressions with tabs stripped.
-			_, bodyText, _ := strings.Cut(info.expr.Body, "\n")
-			if bodyText != "" {
-				bodyDec := linebased.NewDecoder(strings.NewReader(bodyText))
-				for {
-					bodyExpr, err := bodyDec.Decode()
-					if errors.Is(err, io.EOF) {
-						break
-					}
-					if err != nil {
-						break
-					}
-					if bodyExpr.Name == "" {
-						continue
-					}
-					// bodyExpr.Line is 1-indexed within the body.
-					// Document line = define line + body expression line.
-					docLine := info.line + bodyExpr.Line
-					// Body lines have a leading tab in the document, so offset is 1.
-					tokens = append(tokens, semToken{docLine, 1, utf16Len(bodyExpr.Name), tokFunction})
-					// Scan for variable expansions in the body line
-					if docLine < len(d.lines) {
-						tokens = append(tokens, scanVariables(docLine, d.lines[docLine], tokVariable, def.params)...)
-					}
+			// Template body expressions and their variable expansions
+			for _, bodyExpr := range info.bodyExprs {
+				line := bodyExpr.span.startLine
+				tokens = append(tokens, bodyExpr.span.token(tokFunction))
+				if line < len(d.lines) {
+					tokens = append(tokens, scanVariables(line, d.lines[line], tokVariable, def.params)...)
 				}
 			}
 		}
@@ -1348,7 +1886,8 @@ type semToken struct {
 	line, start, length, typ int
 }
 
-// scanVariables finds $name and ${name} patterns in a line.
+// scanVariables finds $name and ${name} patterns in a line, skipping the
+// escaped dollar signs written as $$.
 func scanVariables(lineNum int, line string, tokType int, params params) []semToken {
 	var tokens []semToken
 	i := 0
@@ -1362,6 +1901,10 @@ func scanVariables(lineNum int, line string, tokType int, params params) []semTo
 		if i >= len(line) {
 			break
 		}
+		if line[i] == '$' {
+			i++ // $$ is a literal dollar sign
+			continue
+		}
 		if line[i] == '{' {
 			// ${name}
 			i++
@@ -1383,6 +1926,8 @@ func scanVariables(lineNum int, line string, tokType int, params params) []semTo
 			}
 			if i < len(line) && line[i] == '?' && params.contains(line[nameStart:i]+"?") {
 				i++
+			} else if strings.HasPrefix(line[i:], "...") && params.contains(line[nameStart:i]+"...") {
+				i += len("...")
 			}
 			if i > nameStart {
 				length := utf16Len(line[start:i])
@@ -1428,10 +1973,26 @@ func countArgs(s string, n int) int {
 	return count
 }
 
+// A param is a parameter declaration: a name, optionally followed by "="
+// and a default value.
 type param string
 
+// name returns the name of p, as referred to in the template body.
+func (p param) name() string {
+	name, _, _ := strings.Cut(string(p), "=")
+	return name
+}
+
+func (p param) hasDefault() bool {
+	return strings.Contains(string(p), "=")
+}
+
 func (p param) optional() bool {
-	return strings.HasSuffix(string(p), "?")
+	return strings.HasSuffix(p.name(), "?")
+}
+
+func (p param) variadic() bool {
+	return strings.HasSuffix(p.name(), "...")
 }
 
 type params []param
@@ -1445,7 +2006,7 @@ func parseParams(fields []string) params {
 }
 
 func (p params) contains(name string) bool {
-	return slices.Contains(p, param(name))
+	return slices.ContainsFunc(p, func(p param) bool { return p.name() == name })
 }
 
 func joinParams(params params) string {
@@ -1461,13 +2022,34 @@ func joinParams(params params) string {
 
 func requiredParamCount(params params) int {
 	for i, param := range params {
-		if param.optional() {
+		if param.optional() || param.variadic() {
 			return i
 		}
 	}
 	return len(params)
 }
 
+// misplacedDefault returns the first parameter with a default value that
+// is not optional.
+func misplacedDefault(params params) (param, bool) {
+	for _, param := range params {
+		if param.hasDefault() && !param.optional() {
+			return param, true
+		}
+	}
+	return "", false
+}
+
+// misplacedVariadic returns the first variadic parameter that is not last.
+func misplacedVariadic(params params) (param, bool) {
+	for i, param := range params {
+		if param.variadic() && i != len(params)-1 {
+			return param, true
+		}
+	}
+	return "", false
+}
+
 func invalidOptionalOrder(params params) (required, optional param, ok bool) {
 	for _, param := range params {
 		if param.optional() {
@@ -1483,6 +2065,24 @@ func invalidOptionalOrder(params params) (required, optional param, ok bool) {
 	return "", "", false
 }
 
+// signature returns the call signature of the template with the given name
+// and parameters, with optional parameters in brackets: "greet name [title?]".
+func signature(name string, params params) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, param := range params {
+		b.WriteString(" ")
+		if param.optional() {
+			b.WriteString("[")
+			b.WriteString(string(param))
+			b.WriteString("]")
+		} else {
+			b.WriteString(string(param))
+		}
+	}
+	return b.String()
+}
+
 func utf16Len(s string) int {
 	n := 0
 	for _, r := range s {
@@ -4,9 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"testing/fstest"
+
+	"blake.io/linebased"
 )
 
 func TestDocumentParse(t *testing.T) {
@@ -47,6 +53,27 @@ func TestDocumentParse(t *testing.T) {
 			text:       " bad line\n",
 			wantErrors: []string{"unexpected whitespace"},
 		},
+		{
+			name:       "multiple syntax errors",
+			text:       " bad\n\tstill bad\nok\n\tfine\n\n\tbad again\n",
+			wantErrors: []string{"unexpected whitespace", "unexpected whitespace"},
+		},
+		{
+			name:     "variadic without arguments",
+			text:     "define run cmd args...\n\techo $cmd $args...\nrun ls\nrun ls a b c\n",
+			wantDefs: []string{"run"},
+		},
+		{
+			name:       "variadic missing required",
+			text:       "define run cmd args...\n\techo\nrun\n",
+			wantDefs:   []string{"run"},
+			wantErrors: []string{"run requires 1 argument(s), got 0"},
+		},
+		{
+			name:       "variadic not last",
+			text:       "define bad a... b\n\techo\n",
+			wantErrors: []string{`variadic parameter "a..." must be last`},
+		},
 		{
 			name:       "two params missing both",
 			text:       "define add a b\n\tsum\nadd\n",
@@ -85,6 +112,16 @@ func TestDocumentParse(t *testing.T) {
 			text:       "define greet name? suffix\n\techo\n",
 			wantErrors: []string{`required parameter "suffix" follows optional parameter "name?"`},
 		},
+		{
+			name:     "default param omitted",
+			text:     "define greet name title?=friend\n\techo $title? $name\ngreet Alice\n",
+			wantDefs: []string{"greet"},
+		},
+		{
+			name:       "default on required param",
+			text:       "define greet name=Alice\n\techo\n",
+			wantErrors: []string{`parameter "name=Alice" has a default value but is not optional`},
+		},
 		{
 			name:       "used before defined",
 			text:       "foo\n\ndefine foo\n\tbar\n",
@@ -159,6 +196,21 @@ func TestSymbolAt(t *testing.T) {
 	}
 }
 
+func TestSymbolAtUsesDecoderSpans(t *testing.T) {
+	doc := newDocument("file:///test.lb", "define\t  greet name\n\techo\ngreet Alice\n")
+
+	name, rng, ok := doc.symbolAt(0, 9)
+	if !ok || name != "greet" {
+		t.Fatalf("symbolAt(0, 9) = %q, %v; want greet", name, ok)
+	}
+	if want := (span{0, 9, 0, 14}); rng != want {
+		t.Errorf("symbolAt(0, 9) range = %v, want %v", rng, want)
+	}
+	if def := doc.defs["greet"]; def.char != 9 {
+		t.Errorf("definition char = %d, want 9", def.char)
+	}
+}
+
 func TestReferences(t *testing.T) {
 	doc := newDocument("file:///test.lb", "define greet name\n\techo\ngreet Alice\ngreet Bob\n")
 
@@ -216,6 +268,20 @@ func TestReferencesInTemplateBody(t *testing.T) {
 	}
 }
 
+func TestReferencesCRLF(t *testing.T) {
+	text := "# greeting\r\ndefine greet name\r\n\techo\r\n\r\ndefine outer\r\n\tgreet é\r\ngreet Bob\r\n# end"
+	doc := newDocument("file:///test.lb", text)
+
+	var got []span
+	for _, ref := range doc.references("greet", true) {
+		got = append(got, ref.span)
+	}
+	want := []span{{1, 7, 1, 12}, {5, 1, 5, 6}, {6, 0, 6, 5}}
+	if !slices.Equal(got, want) {
+		t.Errorf("references(greet, true) = %v, want %v", got, want)
+	}
+}
+
 func TestReferencesAcrossIncludes(t *testing.T) {
 	// Test that references finds calls in main file for templates defined in included files
 	fsys := fstest.MapFS{
@@ -366,6 +432,18 @@ func TestSemanticTokensOptionalVariable(t *testing.T) {
 	t.Fatalf("missing variable token for $x? in %#v", tokens)
 }
 
+func TestScanVariablesEscapedDollar(t *testing.T) {
+	params := parseParams([]string{"cmd"})
+	got := scanVariables(0, "\tsh $$HOME $$$cmd ${cmd}$$", 5, params)
+	want := []semToken{
+		{0, 13, 4, 5}, // $cmd
+		{0, 18, 6, 5}, // ${cmd}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("scanVariables = %v; want %v", got, want)
+	}
+}
+
 func TestSemanticTokensInclude(t *testing.T) {
 	// include should be a keyword
 	doc := newDocument("file:///test.lb", "include other.lb\n")
@@ -468,26 +546,7 @@ func TestHoverSignatureMarksOnlyOptionalParamOptional(t *testing.T) {
 	const uri = "file:///test.linebased"
 	doc := newDocument(uri, "define maybe x?\n\techo $x?\nmaybe\n")
 
-	var out bytes.Buffer
-	s := &server{
-		w:    bufio.NewWriter(&out),
-		docs: map[string]*document{uri: doc},
-	}
-	params, err := json.Marshal(struct {
-		TextDocument textDocumentIdentifier `json:"textDocument"`
-		Position     position               `json:"position"`
-	}{
-		TextDocument: textDocumentIdentifier{URI: uri},
-		Position:     position{Line: 2, Character: 0},
-	})
-	if err != nil {
-		t.Fatal(err)
-	}
-	if err := s.handleHover(&request{ID: json.RawMessage(`1`), Params: params}); err != nil {
-		t.Fatal(err)
-	}
-
-	got := hoverResponseValue(t, out.Bytes())
+	got := hover(t, uri, doc, position{Line: 2, Character: 0})
 	want := "```linebased\nmaybe [x?]\n```"
 	if !strings.Contains(got, want) {
 		t.Fatalf("hover signature:\n got: %q\nwant to contain: %q", got, want)
@@ -497,6 +556,21 @@ func TestHoverSignatureMarksOnlyOptionalParamOptional(t *testing.T) {
 	}
 }
 
+func TestHoverSignatureShowsDefault(t *testing.T) {
+	const uri = "file:///test.linebased"
+	doc := newDocument(uri, "define greet name title?=friend\n\techo Hello, $title? $name\ngreet Alice\n")
+
+	got := hover(t, uri, doc, position{Line: 2, Character: 0})
+	for _, want := range []string{
+		"```linebased\ngreet name [title?=friend]\n```",
+		"echo Hello, friend Alice",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("hover:\n got: %q\nwant to contain: %q", got, want)
+		}
+	}
+}
+
 func TestReplyNilIncludesResultNull(t *testing.T) {
 	var out bytes.Buffer
 	s := &server{w: bufio.NewWriter(&out)}
@@ -624,6 +698,29 @@ func hoverResponseValue(t *testing.T, msg []byte) string {
 	return resp.Result.Contents.Value
 }
 
+func hover(t *testing.T, uri string, doc *document, pos position) string {
+	t.Helper()
+	var out bytes.Buffer
+	s := &server{
+		w:    bufio.NewWriter(&out),
+		docs: map[string]*document{uri: doc},
+	}
+	params, err := json.Marshal(struct {
+		TextDocument textDocumentIdentifier `json:"textDocument"`
+		Position     position               `json:"position"`
+	}{
+		TextDocument: textDocumentIdentifier{URI: uri},
+		Position:     pos,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.handleHover(&request{ID: json.RawMessage(`1`), Params: params}); err != nil {
+		t.Fatal(err)
+	}
+	return hoverResponseValue(t, out.Bytes())
+}
+
 type codeActionResult struct {
 	Title string `json:"title"`
 	Kind  string `json:"kind"`
@@ -766,9 +863,9 @@ func TestLocalDefOverridesInclude(t *testing.T) {
 }
 
 func TestRootedIncludes(t *testing.T) {
-	// Test that include paths are rooted at the filesystem root.
-	// Include paths must be simple names (no slashes) and the .linebased
-	// extension is added automatically.
+	// Test that include paths are rooted at the filesystem root, not at
+	// the including file, and the .linebased extension is added
+	// automatically.
 	fsys := fstest.MapFS{
 		"utils.linebased": &fstest.MapFile{
 			Data: []byte("include shared\ndefine util_fn\n\thelper\n"),
@@ -800,3 +897,666 @@ func TestRootedIncludes(t *testing.T) {
 		t.Errorf("helper definition uri: got %q, want %q", def.uri, "file:///shared.linebased")
 	}
 }
+
+func TestPrivateTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib.linebased": &fstest.MapFile{
+			Data: []byte("define _helper x\n\techo $x\ndefine pub x\n\t_helper $x\n"),
+		},
+	}
+
+	// The private helper of lib is not visible to the including file,
+	// and calling it is an error.
+	doc := newDocumentFS("file:///main.lb", "include lib\npub 1\n_helper\n_other\n", fsys)
+	if _, ok := doc.defs["pub"]; !ok {
+		t.Error("expected pub to be defined")
+	}
+	if def, ok := doc.defs["_helper"]; ok {
+		t.Errorf("private _helper of lib is visible: %+v", def)
+	}
+	wantErrs := []diagError{{line: 2, msg: `template "_helper" is private to lib.linebased`}}
+	if !slices.Equal(doc.errors, wantErrs) {
+		t.Errorf("errors = %v, want %v", doc.errors, wantErrs)
+	}
+
+	// A private template of the same name in the document is its own.
+	doc = newDocumentFS("file:///main.lb", "include lib\ndefine _helper\n\techo main\n_helper\n", fsys)
+	if def, ok := doc.defs["_helper"]; !ok || def.uri != "file:///main.lb" {
+		t.Errorf("_helper definition = %+v, %v; want from file:///main.lb", def, ok)
+	}
+	for _, r := range doc.references("_helper", true) {
+		if r.uri != "file:///main.lb" {
+			t.Errorf("reference to _helper in %s:%d", r.uri, r.span.startLine+1)
+		}
+	}
+}
+
+func TestOptionalInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"local.linebased": &fstest.MapFile{
+			Data: []byte("define override\n\techo local\n"),
+		},
+	}
+	const uri = "file:///main.lb"
+	doc := newDocumentFS(uri, "include missing\ninclude? absent\ninclude? local\n", fsys)
+
+	if def, ok := doc.defs["override"]; !ok || def.uri != "file:///local.linebased" {
+		t.Errorf("override definition = %+v, %v; want from file:///local.linebased", def, ok)
+	}
+	// Only the missing hard include is an error.
+	wantErrs := []diagError{{line: 0, msg: `cannot find include file "missing.linebased"`}}
+	if !slices.Equal(doc.errors, wantErrs) {
+		t.Errorf("errors = %v, want %v", doc.errors, wantErrs)
+	}
+
+	for _, tt := range []struct {
+		line int
+		want string
+	}{
+		{0, "Includes `missing.linebased`, which does not exist."},
+		{1, "Optionally includes `absent.linebased`, which does not exist; it is skipped."},
+		{2, "Optionally includes `/local.linebased`."},
+	} {
+		if got := hover(t, uri, doc, position{Line: tt.line, Character: 10}); got != tt.want {
+			t.Errorf("hover on line %d:\n got: %q\nwant: %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestIncludePathAt(t *testing.T) {
+	doc := newDocumentFS("file:///main.lb", "include lib\ninclude  lib\ninclude?\tlib\n", fstest.MapFS{})
+	tests := []struct {
+		line, char int
+		want       span // zero for none
+	}{
+		{0, 8, span{0, 8, 0, 11}},
+		{1, 8, span{}}, // the second space
+		{1, 9, span{1, 9, 1, 12}},
+		{1, 11, span{1, 9, 1, 12}},
+		{2, 9, span{2, 9, 2, 12}},
+		{2, 12, span{}},
+	}
+	for _, tt := range tests {
+		path, s, ok := doc.includePathAt(tt.line, tt.char)
+		switch {
+		case ok != (tt.want != span{}):
+			t.Errorf("includePathAt(%d, %d) = %q, %v; want %v", tt.line, tt.char, path, ok, tt.want)
+		case ok && (path != "lib" || s != tt.want):
+			t.Errorf("includePathAt(%d, %d) = %q, %v; want %q, %v", tt.line, tt.char, path, s, "lib", tt.want)
+		}
+	}
+}
+
+func TestIncludeSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"project/lib/http.linebased": "include lib/url\ndefine get\n\techo project get\n",
+		"project/lib/url.linebased":  "define parse\n\techo parse\n",
+		"std/http.linebased":         "define get\n\techo std get\n",
+		"std/log.linebased":          "define info\n\techo std info\n",
+		"secret.linebased":           "define leak\n\techo leaked\n",
+	}
+	for name, text := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("LINEBASEDPATH", filepath.Join(dir, "std"))
+
+	root := filepath.ToSlash(dir)
+	text := "include lib/http\ninclude log\ninclude ../secret\n"
+	doc := newDocument("file://"+root+"/project/main.lb", text)
+
+	wantURIs := map[string]string{
+		"get":   "file://" + root + "/project/lib/http.linebased",
+		"parse": "file://" + root + "/project/lib/url.linebased",
+		"info":  "file://" + root + "/std/log.linebased",
+	}
+	for name, want := range wantURIs {
+		def, ok := doc.defs[name]
+		if !ok {
+			t.Errorf("expected %s to be defined", name)
+			continue
+		}
+		if def.uri != want {
+			t.Errorf("%s definition uri: got %q, want %q", name, def.uri, want)
+		}
+	}
+	if _, ok := doc.defs["leak"]; ok {
+		t.Error("include outside the root was followed")
+	}
+	wantErrs := []diagError{{line: 2, msg: `invalid include path "../secret"`}}
+	if !slices.Equal(doc.errors, wantErrs) {
+		t.Errorf("errors = %v, want %v", doc.errors, wantErrs)
+	}
+}
+
+func TestIncludeOverlay(t *testing.T) {
+	root := filepath.ToSlash(t.TempDir())
+	libURI := "file://" + root + "/lib.linebased"
+	mainURI := "file://" + root + "/main.lb"
+
+	var out bytes.Buffer
+	s := &server{
+		w:    bufio.NewWriter(&out),
+		docs: make(map[string]*document),
+	}
+	send := func(handle func(*request) error, params any) {
+		t.Helper()
+		data, err := json.Marshal(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handle(&request{Params: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type item struct {
+		URI  string `json:"uri"`
+		Text string `json:"text,omitempty"`
+	}
+	type change struct {
+		Text string `json:"text"`
+	}
+
+	// The library is open in the editor but was never saved.
+	send(s.handleDidOpen, map[string]any{"textDocument": item{libURI, "define greet name\n\techo $name\n"}})
+	send(s.handleDidOpen, map[string]any{"textDocument": item{mainURI, "include lib\ngreet\n"}})
+	doc := s.docs[mainURI]
+	if def, ok := doc.defs["greet"]; !ok || def.uri != libURI {
+		t.Fatalf("greet definition = %+v, %v; want from %s", def, ok, libURI)
+	}
+	wantErrs := []diagError{{line: 1, msg: "greet requires 1 argument(s), got 0"}}
+	if !slices.Equal(doc.errors, wantErrs) {
+		t.Errorf("errors = %v, want %v", doc.errors, wantErrs)
+	}
+
+	// Editing the library reparses the file that includes it.
+	send(s.handleDidChange, map[string]any{
+		"textDocument":   item{URI: libURI},
+		"contentChanges": []change{{"define greet name?\n\techo $name?\n"}},
+	})
+	if len(doc.errors) != 0 {
+		t.Errorf("errors after change = %v, want none", doc.errors)
+	}
+
+	// Closing it leaves only the file on disk, which does not exist.
+	send(s.handleDidClose, map[string]any{"textDocument": item{URI: libURI}})
+	if _, ok := doc.defs["greet"]; ok {
+		t.Error("greet still defined after closing unsaved library")
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.linebased":     &fstest.MapFile{},
+		"greet.linebased":    &fstest.MapFile{Data: []byte("# Says hello.\ndefine greet name title?\n\techo Hello, $title? $name\n")},
+		"notes.txt":          &fstest.MapFile{},
+		".hidden.linebased":  &fstest.MapFile{},
+		"lib/http.linebased": &fstest.MapFile{},
+	}
+	text := "include greet\n" +
+		"include? \n" +
+		"include lib/h\n" +
+		"define deploy app hosts...\n" +
+		"\tgr\n" +
+		"\tssh ${h $$a $ap ${a}\n" +
+		"g\n" +
+		"echo g\n"
+	doc := newDocumentFS("file:///main.linebased", text, fsys)
+
+	type want struct {
+		label, newText string
+		start          int // character at which the edit starts
+	}
+	tests := []struct {
+		line, char int
+		want       []want
+	}{
+		{1, 9, []want{{"greet", "greet", 9}, {"lib/", "lib/", 9}}},
+		{2, 13, []want{{"http", "lib/http", 8}}},
+		{4, 3, []want{{"deploy", "deploy ${1:app}", 1}, {"greet", "greet ${1:name}", 1}}},
+		{5, 8, []want{{"app", "app}", 7}, {"hosts", "hosts}", 7}, {"hosts...", "hosts...}", 7}}},
+		{5, 12, nil}, // $$ is not a reference
+		{5, 16, []want{{"app", "app", 14}, {"hosts", "hosts", 14}, {"hosts...", "hosts...", 14}}},
+		{5, 19, []want{{"app", "app", 19}, {"hosts", "hosts", 19}, {"hosts...", "hosts...", 19}}},
+		{6, 1, []want{{"deploy", "deploy ${1:app}", 0}, {"greet", "greet ${1:name}", 0}}},
+		{7, 6, nil},
+	}
+	for _, tt := range tests {
+		var got []want
+		for _, item := range doc.completions(tt.line, tt.char) {
+			got = append(got, want{item.Label, item.TextEdit.NewText, item.TextEdit.Range.Start.Character})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("completions at %d:%d:\n got %v\nwant %v", tt.line, tt.char, got, tt.want)
+		}
+	}
+
+	items := doc.completions(6, 1)
+	if len(items) != 2 || items[1].Documentation == nil || items[1].Documentation.Value != "Says hello." {
+		t.Errorf("greet completion lacks its doc comment: %+v", items)
+	} else if items[1].Detail != "greet name [title?]" {
+		t.Errorf("greet completion detail = %q, want %q", items[1].Detail, "greet name [title?]")
+	}
+}
+
+func TestSignatureHelp(t *testing.T) {
+	const uri = "file:///test.linebased"
+	text := "# Deploys an app.\n" +
+		"define deploy app env?=prod note?\n" +
+		"\techo $app $env? $note?\n" +
+		"define all\n" +
+		"\tdeploy web \n" +
+		"deploy web staging hello world\n" +
+		"echo deploy \n" +
+		"define noop\n" +
+		"\techo\n" +
+		"noop \n"
+	doc := newDocument(uri, text)
+
+	tests := []struct {
+		line, char int
+		active     int // -1 for no signature help
+	}{
+		{5, 6, -1}, // in the name
+		{5, 7, 0},
+		{5, 10, 0},
+		{5, 11, 1},
+		{5, 30, 2}, // the last parameter takes the rest of the line
+		{4, 12, 1}, // in a define body
+		{6, 12, -1},
+		{2, 6, -1}, // not a call
+		{9, 5, -1}, // no parameters
+	}
+	for _, tt := range tests {
+		help, ok := doc.signatureHelp(tt.line, tt.char)
+		switch {
+		case !ok && tt.active >= 0:
+			t.Errorf("signatureHelp(%d, %d): none, want active parameter %d", tt.line, tt.char, tt.active)
+		case ok && tt.active < 0:
+			t.Errorf("signatureHelp(%d, %d) = %+v, want none", tt.line, tt.char, help)
+		case ok && help.ActiveParameter != tt.active:
+			t.Errorf("signatureHelp(%d, %d): active parameter %d, want %d", tt.line, tt.char, help.ActiveParameter, tt.active)
+		}
+	}
+
+	var out bytes.Buffer
+	s := &server{
+		w:    bufio.NewWriter(&out),
+		docs: map[string]*document{uri: doc},
+	}
+	params, err := json.Marshal(struct {
+		TextDocument textDocumentIdentifier `json:"textDocument"`
+		Position     position               `json:"position"`
+	}{
+		TextDocument: textDocumentIdentifier{URI: uri},
+		Position:     position{Line: 5, Character: 11},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.handleSignatureHelp(&request{ID: json.RawMessage(`1`), Params: params}); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Result signatureHelp `json:"result"`
+	}
+	if err := json.Unmarshal(lspMessageBody(t, out.Bytes()), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result.Signatures) != 1 {
+		t.Fatalf("signatures = %+v, want 1", resp.Result.Signatures)
+	}
+	sig := resp.Result.Signatures[0]
+	if want := "deploy app [env?=prod] [note?]"; sig.Label != want {
+		t.Errorf("label = %q, want %q", sig.Label, want)
+	}
+	if sig.Documentation == nil || sig.Documentation.Value != "Deploys an app." {
+		t.Errorf("documentation = %+v, want %q", sig.Documentation, "Deploys an app.")
+	}
+	var labels []string
+	for _, p := range sig.Parameters {
+		labels = append(labels, sig.Label[p.Label[0]:p.Label[1]])
+	}
+	if want := []string{"app", "env?=prod", "note?"}; !slices.Equal(labels, want) {
+		t.Errorf("parameter labels = %q, want %q", labels, want)
+	}
+	if last := sig.Parameters[2].Documentation; last == nil || last.Value != "Takes the rest of the line." {
+		t.Errorf("last parameter documentation = %+v", last)
+	}
+	if resp.Result.ActiveParameter != 1 {
+		t.Errorf("active parameter = %d, want 1", resp.Result.ActiveParameter)
+	}
+}
+
+func TestFormatFile(t *testing.T) {
+	src := []byte("echo   one\n\n\n\necho two\necho three\necho four\necho five\n")
+
+	var out bytes.Buffer
+	if err := formatFile("a.linebased", src, &out, fmtOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo one\n\necho two\necho three\necho four\necho five\n"; out.String() != want {
+		t.Errorf("formatted:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := formatFile("a.linebased", src, &out, fmtOptions{list: true, diff: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := `a.linebased
+diff a.linebased.orig a.linebased
+--- a.linebased.orig
++++ a.linebased
+@@ -1,6 +1,4 @@
+-echo   one
+-
+-
++echo one
+ 
+ echo two
+ echo three
+`
+	if out.String() != want {
+		t.Errorf("list and diff:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	formatted := []byte("echo one\n")
+	if err := formatFile("b.linebased", formatted, &out, fmtOptions{list: true, diff: true}); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("formatted file reported:\n%s", out.String())
+	}
+
+	err := formatFile("c.linebased", []byte("a\n\n  orphan\n"), &out, fmtOptions{})
+	if err == nil || err.Error() != "c.linebased:3: unexpected whitespace at start of line" {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	old := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n")
+	new := []byte("A\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nL")
+	want := `diff old new
+--- old
++++ new
+@@ -1,4 +1,4 @@
+-a
++A
+ b
+ c
+ d
+@@ -9,4 +9,4 @@
+ i
+ j
+ k
+-l
++L
+\ No newline at end of file
+`
+	if got := string(unifiedDiff("old", "new", old, new)); got != want {
+		t.Errorf("unifiedDiff:\n%s\nwant:\n%s", got, want)
+	}
+	if got := unifiedDiff("old", "new", old, old); got != nil {
+		t.Errorf("unifiedDiff of equal files = %q, want nil", got)
+	}
+}
+
+func TestDiffer(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	lines := func() []string {
+		s := make([]string, r.IntN(12))
+		for i := range s {
+			s[i] = string(rune('a'+r.IntN(4))) + "\n"
+		}
+		return s
+	}
+	for range 1000 {
+		a, b := lines(), lines()
+		d := &differ{a: a, b: b}
+		d.diff(0, len(a), 0, len(b))
+		var gotA, gotB []string
+		common := 0
+		for _, op := range d.ops {
+			if op.kind != '+' {
+				gotA = append(gotA, op.text)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.text)
+			}
+			if op.kind == ' ' {
+				common++
+			}
+		}
+		if !slices.Equal(gotA, a) || !slices.Equal(gotB, b) {
+			t.Fatalf("diff(%q, %q) = %v; does not rebuild both", a, b, d.ops)
+		}
+		if want := lcsLengths(a, b, false)[len(b)]; common != want {
+			t.Fatalf("diff(%q, %q) keeps %d lines; want %d", a, b, common, want)
+		}
+	}
+}
+
+func TestVetFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"_lib.linebased": "define shout msg\n\techo $msg!\n",
+		"ok.linebased":   "include _lib\nshout hi\n",
+		"bad.linebased": "greet Alice\n" +
+			"define greet name\n\techo hello, $name\n" +
+			"define opt a? b\n\techo $a $b\n" +
+			"  indented\n" +
+			"greet\n",
+		"expand.linebased": "include _lib\ndefine twice x\n\tshout $x\n\tshout\ntwice hi\n",
+		"multi.linebased": "define a x\n\techo $y\ndefine b x\n\techo $z\n" +
+			"a 1\nb 2\ninclude _lib\nshout\n",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := vetFile(filepath.Join(dir, "ok.linebased"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("vetFile(ok.linebased) = %v, want no findings", got)
+	}
+
+	got, err = vetFile(filepath.Join(dir, "bad.linebased"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.linebased")
+	want := []finding{
+		{bad, 1, `template "greet" used before definition on line 2`},
+		{bad, 4, `required parameter "b" follows optional parameter "a?"`},
+		{bad, 6, "unexpected whitespace at start of line"},
+		{bad, 7, "greet requires 1 argument(s), got 0"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("vetFile(bad.linebased):\ngot  %v\nwant %v", got, want)
+	}
+
+	got, err = vetFile(filepath.Join(dir, "expand.linebased"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].File != filepath.Join(dir, "expand.linebased") || got[0].Line != 5 {
+		t.Errorf("vetFile(expand.linebased) = %v, want one finding on line 5", got)
+	}
+
+	// Expansion continues after an error, reporting every one.
+	got, err = vetFile(filepath.Join(dir, "multi.linebased"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi := filepath.Join(dir, "multi.linebased")
+	want = []finding{
+		{multi, 1, `unknown parameter reference: "y"`},
+		{multi, 3, `unknown parameter reference: "z"`},
+		{multi, 8, "shout requires 1 argument(s), got 0"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("vetFile(multi.linebased):\ngot  %v\nwant %v", got, want)
+	}
+
+	// Errors in a file found in $LINEBASEDPATH are reported in that file.
+	std := t.TempDir()
+	t.Setenv("LINEBASEDPATH", std)
+	if err := os.WriteFile(filepath.Join(std, "std.linebased"), []byte("define need x\n\techo $x\nneed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "usestd.linebased"), []byte("include std\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = vetFile(filepath.Join(dir, "usestd.linebased"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []finding{{filepath.Join(std, "std.linebased"), 3, `template "need" expects 1 arguments, got 0`}}
+	if !slices.Equal(got, want) {
+		t.Errorf("vetFile(usestd.linebased):\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestExpandedJSON(t *testing.T) {
+	fsys := fstest.MapFS{"s.linebased": &fstest.MapFile{Data: []byte(
+		"# say hi\necho hi\ndefine greet name\n\techo hello, $name\ngreet Alice\n",
+	)}}
+	var got []string
+	for expr, err := range linebased.Expand("s.linebased", fsys) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(newExpandedJSON(expr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	want := []string{
+		`{"name":"echo","body":"hi\n","comment":"# say hi\n","file":"s.linebased","line":2,"where":"s.linebased:2: main@2","stack":[]}`,
+		`{"name":"echo","body":"hello, Alice\n","file":"s.linebased","line":1,"where":"s.linebased:5: greet@1","stack":[{"name":"greet","args":["Alice"],"file":"s.linebased","line":5,"where":"s.linebased:5: main@5"}]}`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	text := "include? common\n" +
+		"\n" +
+		"# Deploys an app.\n" +
+		"define deploy app env?=prod\n" +
+		"\techo $app $env?\n" +
+		"deploy web\n"
+	doc := newDocument("file:///test.linebased", text)
+	syms := doc.symbols()
+
+	var got []string
+	for _, sym := range syms {
+		got = append(got, sym.Name+" ("+sym.Detail+")")
+	}
+	want := []string{"common (include?)", "deploy (deploy app [env?=prod])", "deploy (web)"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("symbols = %q, want %q", got, want)
+	}
+
+	def := syms[1]
+	if def.Kind != symbolFunction {
+		t.Errorf("define kind = %d, want %d", def.Kind, symbolFunction)
+	}
+	if def.Range.Start.Line != 3 || def.Range.End.Line != 4 {
+		t.Errorf("define range = %+v, want lines 3 to 4", def.Range)
+	}
+	if r := def.SelectionRange; r.Start.Character != 7 || r.End.Character != 13 {
+		t.Errorf("define selection range = %+v, want characters 7 to 13", r)
+	}
+	var params []string
+	for _, p := range def.Children {
+		line := doc.lines[p.Range.Start.Line]
+		params = append(params, p.Name+"="+line[p.Range.Start.Character:p.Range.End.Character]+" "+p.Detail)
+	}
+	if want := []string{"app=app ", "env?=env?=prod default prod"}; !slices.Equal(params, want) {
+		t.Errorf("parameters = %q, want %q", params, want)
+	}
+	if r := syms[0].SelectionRange; r.Start.Character != 9 || r.End.Character != 15 {
+		t.Errorf("include selection range = %+v, want characters 9 to 15", r)
+	}
+}
+
+func TestWorkspaceSymbols(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.linebased":        "define deploy app\n\techo $app\n",
+		"lib/net.linebased":     "define ping host\n\techo $host\ndefine _private\n\techo\n",
+		"lib/readme.txt":        "define ignored\n",
+		".git/hooks.linebased":  "define hidden\n",
+		"lib/other.linebased":   "deploy web\n",
+		"open/edited.linebased": "define stale\n",
+	}
+	for name, text := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An open document is searched as edited, not as saved.
+	editedURI := "file://" + filepath.ToSlash(filepath.Join(dir, "open/edited.linebased"))
+	var out bytes.Buffer
+	s := &server{
+		w: bufio.NewWriter(&out),
+		docs: map[string]*document{
+			editedURI: newDocument(editedURI, "define fresh\n\techo\n"),
+		},
+	}
+	params, err := json.Marshal(map[string]string{"rootUri": "file://" + filepath.ToSlash(dir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.handleInitialize(&request{ID: json.RawMessage(`1`), Params: params}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"net.linebased: ping", "net.linebased: _private", "main.linebased: deploy", "edited.linebased: fresh"}},
+		{"P", []string{"net.linebased: ping", "net.linebased: _private", "main.linebased: deploy"}},
+		{"nothing", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, sym := range s.workspaceSymbols(tt.query) {
+			got = append(got, filepath.Base(sym.Location.URI)+": "+sym.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("workspaceSymbols(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	syms := s.workspaceSymbols("ping")
+	if len(syms) != 1 {
+		t.Fatalf("workspaceSymbols(%q) = %+v, want 1 symbol", "ping", syms)
+	}
+	if got := syms[0].ContainerName; got != "lib/net.linebased" {
+		t.Errorf("container = %q, want %q", got, "lib/net.linebased")
+	}
+	if r := syms[0].Location.Range; r.Start.Line != 0 || r.Start.Character != 7 || r.End.Character != 11 {
+		t.Errorf("range = %+v, want line 0, characters 7 to 11", r)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+type signatureHelp struct {
+	Signatures      []signatureInformation `json:"signatures"`
+	ActiveSignature int                    `json:"activeSignature"`
+	ActiveParameter int                    `json:"activeParameter"`
+}
+
+type signatureInformation struct {
+	Label         string                 `json:"label"`
+	Documentation *markupContent         `json:"documentation,omitempty"`
+	Parameters    []parameterInformation `json:"parameters"`
+}
+
+type parameterInformation struct {
+	Label         [2]int         `json:"label"` // UTF-16 offsets in the signature label
+	Documentation *markupContent `json:"documentation,omitempty"`
+}
+
+func (s *server) handleSignatureHelp(msg *request) error {
+	if msg.ID == nil {
+		return nil
+	}
+	var p struct {
+		TextDocument textDocumentIdentifier `json:"textDocument"`
+		Position     position               `json:"position"`
+	}
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return s.sendError(msg.ID, codeInvalidParams, err.Error())
+	}
+	doc := s.docs[p.TextDocument.URI]
+	if doc == nil {
+		return s.reply(msg.ID, nil)
+	}
+	help, ok := doc.signatureHelp(p.Position.Line, p.Position.Character)
+	if !ok {
+		return s.reply(msg.ID, nil)
+	}
+	return s.reply(msg.ID, help)
+}
+
+// signatureHelp returns the signature of the template called on the given
+// line, with the parameter for the argument at the position active.
+// Arguments are split at whitespace as for a call, and once the last
+// parameter is reached it takes the rest of the line.
+func (d *document) signatureHelp(line, char int) (signatureHelp, bool) {
+	if line < 0 || line >= len(d.lines) {
+		return signatureHelp{}, false
+	}
+	text := d.lines[line]
+	prefix := text[:byteOffset(text, char)]
+	call := strings.TrimLeft(prefix, "\t")
+	if _, inBody := d.defineAt(line); (len(call) < len(prefix)) != inBody {
+		return signatureHelp{}, false // a continuation line
+	}
+	i := strings.IndexFunc(call, unicode.IsSpace)
+	if i < 0 {
+		return signatureHelp{}, false // still typing the name
+	}
+	name, args := call[:i], call[i:]
+	def, ok := d.defs[name]
+	if !ok || len(def.params) == 0 {
+		return signatureHelp{}, false // nothing to help with
+	}
+
+	// The argument at the cursor is the one after those already complete.
+	active := len(strings.Fields(args))
+	if !strings.HasSuffix(args, " ") && !strings.HasSuffix(args, "\t") {
+		active--
+	}
+	active = max(0, min(active, len(def.params)-1))
+
+	sig := signatureInformation{
+		Label:      signature(name, def.params),
+		Parameters: []parameterInformation{},
+	}
+	if def.doc != "" {
+		sig.Documentation = &markupContent{Kind: "markdown", Value: def.doc}
+	}
+	pos := utf16Len(name)
+	for j, p := range def.params {
+		pos++ // the space before the parameter
+		n := utf16Len(string(p))
+		if p.optional() {
+			pos++ // "["
+		}
+		info := parameterInformation{Label: [2]int{pos, pos + n}}
+		if j == len(def.params)-1 {
+			rest := "Takes the rest of the line."
+			if p.variadic() {
+				rest = "Takes the remaining arguments, zero or more."
+			}
+			info.Documentation = &markupContent{Kind: "markdown", Value: rest}
+		}
+		sig.Parameters = append(sig.Parameters, info)
+		pos += n
+		if p.optional() {
+			pos++ // "]"
+		}
+	}
+	return signatureHelp{
+		Signatures:      []signatureInformation{sig},
+		ActiveParameter: active,
+	}, true
+}
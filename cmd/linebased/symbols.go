@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"blake.io/linebased/cst"
+)
+
+// Symbol kinds, from the LSP specification.
+const (
+	symbolFile     = 1
+	symbolFunction = 12
+	symbolVariable = 13
+	symbolEvent    = 24
+)
+
+type documentSymbol struct {
+	Name           string           `json:"name"`
+	Detail         string           `json:"detail,omitempty"`
+	Kind           int              `json:"kind"`
+	Range          lspRange         `json:"range"`
+	SelectionRange lspRange         `json:"selectionRange"`
+	Children       []documentSymbol `json:"children,omitempty"`
+}
+
+type symbolInformation struct {
+	Name          string   `json:"name"`
+	Kind          int      `json:"kind"`
+	Location      location `json:"location"`
+	ContainerName string   `json:"containerName,omitempty"`
+}
+
+func (s *server) handleDocumentSymbol(msg *request) error {
+	if msg.ID == nil {
+		return nil
+	}
+	var p struct {
+		TextDocument textDocumentIdentifier `json:"textDocument"`
+	}
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return s.sendError(msg.ID, codeInvalidParams, err.Error())
+	}
+	symbols := []documentSymbol{}
+	if doc := s.docs[p.TextDocument.URI]; doc != nil {
+		symbols = append(symbols, doc.symbols()...)
+	}
+	return s.reply(msg.ID, symbols)
+}
+
+// symbols returns the outline of the document: its defines, with their
+// parameters as children, its includes, and its other commands.
+func (d *document) symbols() []documentSymbol {
+	var symbols []documentSymbol
+	for _, info := range d.exprs {
+		expr := info.expr
+		sym := documentSymbol{
+			Name:           expr.Name,
+			Kind:           symbolEvent,
+			Range:          d.exprRange(info),
+			SelectionRange: info.nameSpan.toLSP(),
+		}
+		header, _, _ := strings.Cut(expr.Body, "\n")
+		switch {
+		case expr.Name == "":
+			continue // blank line or comment
+		case expr.Name == "define":
+			if info.definedName == "" {
+				continue
+			}
+			params := parseParams(strings.Fields(header)[1:])
+			sym.Name = info.definedName
+			sym.Detail = signature(info.definedName, params)
+			sym.Kind = symbolFunction
+			sym.SelectionRange = info.definedSpan.toLSP()
+			sym.Children = d.paramSymbols(info, header, params)
+		case isInclude(expr.Name):
+			includePath := strings.TrimSpace(header)
+			if includePath == "" {
+				break
+			}
+			sym.Name = includePath
+			sym.Detail = expr.Name
+			sym.Kind = symbolFile
+			sym.SelectionRange = toSpan(d.lines, prefixSpan(expr.TailSpan, len(includePath))).toLSP()
+		default:
+			sym.Detail = strings.TrimSpace(header)
+		}
+		symbols = append(symbols, sym)
+	}
+	return symbols
+}
+
+// paramSymbols returns the parameters declared in the header of the define
+// expression info.
+func (d *document) paramSymbols(info exprInfo, header string, params params) []documentSymbol {
+	var symbols []documentSymbol
+	rest := header[len(info.definedName):]
+	pos := info.definedSpan.endChar
+	for _, p := range params {
+		i := strings.Index(rest, string(p))
+		start := pos + utf16Len(rest[:i])
+		pos = start + utf16Len(string(p))
+		rest = rest[i+len(p):]
+		rng := span{info.line, start, info.line, pos}.toLSP()
+		sym := documentSymbol{
+			Name:           p.name(),
+			Kind:           symbolVariable,
+			Range:          rng,
+			SelectionRange: rng,
+		}
+		if _, value, ok := strings.Cut(string(p), "="); ok {
+			sym.Detail = "default " + value
+		}
+		symbols = append(symbols, sym)
+	}
+	return symbols
+}
+
+func (s *server) handleWorkspaceSymbol(msg *request) error {
+	if msg.ID == nil {
+		return nil
+	}
+	var p struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return s.sendError(msg.ID, codeInvalidParams, err.Error())
+	}
+	return s.reply(msg.ID, s.workspaceSymbols(p.Query))
+}
+
+// workspaceSymbols returns the templates defined in the .linebased files
+// under the workspace folders and in the open documents whose names
+// contain query, ignoring case. Open documents are searched as edited.
+func (s *server) workspaceSymbols(query string) []symbolInformation {
+	texts := make(map[string]string) // file path to text, for open documents
+	var files []string
+	for _, doc := range s.docs {
+		if _, ok := uriPath(doc.uri); !ok {
+			continue // not a file
+		}
+		texts[doc.source] = doc.text
+		files = append(files, doc.source)
+	}
+	for _, root := range s.roots {
+		filepath.WalkDir(root, func(name string, e fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				return nil // skip what cannot be read
+			case e.IsDir() && name != root && strings.HasPrefix(e.Name(), "."):
+				return filepath.SkipDir
+			case !e.IsDir() && strings.HasSuffix(name, ".linebased"):
+				files = append(files, filepath.ToSlash(name))
+			}
+			return nil
+		})
+	}
+	slices.Sort(files)
+	files = slices.Compact(files)
+
+	query = strings.ToLower(query)
+	symbols := []symbolInformation{}
+	for _, file := range files {
+		text, ok := texts[file]
+		if !ok {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			text = string(data)
+		}
+		for _, def := range fileDefines(text) {
+			if !strings.Contains(strings.ToLower(def.name), query) {
+				continue
+			}
+			symbols = append(symbols, symbolInformation{
+				Name:          def.name,
+				Kind:          symbolFunction,
+				Location:      location{URI: "file://" + file, Range: def.span.toLSP()},
+				ContainerName: s.relPath(file),
+			})
+		}
+	}
+	return symbols
+}
+
+// fileDefines returns the names of the templates defined in text and the
+// spans of the names.
+func fileDefines(text string) []bodyExprInfo {
+	file, _ := cst.Parse([]byte(text))
+	lines := splitLines(text)
+	var defs []bodyExprInfo
+	for _, node := range file.Exprs {
+		if node.Err != nil || node.Name() != "define" {
+			continue
+		}
+		expr := node.Expression()
+		header, _, _ := strings.Cut(expr.Body, "\n")
+		if fields := strings.Fields(header); len(fields) > 0 {
+			defs = append(defs, bodyExprInfo{
+				name: fields[0],
+				span: toSpan(lines, prefixSpan(expr.TailSpan, len(fields[0]))),
+			})
+		}
+	}
+	return defs
+}
+
+// relPath returns file relative to the workspace folder containing it, or
+// file itself if it is in none.
+func (s *server) relPath(file string) string {
+	for _, root := range s.roots {
+		if rel, err := filepath.Rel(root, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return file
+}
@@ -0,0 +1,357 @@
+// Package cst provides a lossless concrete syntax tree for linebased source.
+//
+// A [linebased.Decoder] reports what a script means: it drops line
+// terminators, the exact whitespace between a name and its tail, the leading
+// tab of continuation lines, and comments at the end of the input. A [File]
+// keeps every byte. Printing an unmodified File reproduces its source
+// exactly, and editing one expression leaves the bytes of every other
+// expression untouched:
+//
+//	f, err := cst.Parse(src)
+//	if err != nil {
+//		// f is still complete; malformed lines are kept as-is.
+//	}
+//	for _, e := range f.Exprs {
+//		if e.Name() == "greet" {
+//			if err := e.SetName("welcome"); err != nil {
+//				log.Fatal(err)
+//			}
+//		}
+//	}
+//	os.Stdout.Write(f.Bytes())
+//
+// Lines record the position where they appeared in the parsed source.
+// Positions are not updated by edits; parse the printed file again to
+// refresh them.
+package cst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"blake.io/linebased"
+)
+
+// File is the concrete syntax tree of a linebased source file.
+type File struct {
+	// Exprs holds the expressions of the file in source order.
+	Exprs []*Expr
+
+	// Trailing holds the comment lines that follow the last expression.
+	Trailing []Line
+}
+
+// Line is a single line of source.
+type Line struct {
+	Pos  linebased.Pos // position of the first byte of the line
+	Text string        // content of the line, without its terminator
+	EOL  string        // "\n", "\r\n", or "" for an unterminated final line
+}
+
+// end returns the position just past the content of l.
+func (l Line) end() linebased.Pos {
+	return linebased.Pos{
+		Offset: l.Pos.Offset + len(l.Text),
+		Line:   l.Pos.Line,
+		Column: l.Pos.Column + len(l.Text),
+	}
+}
+
+// Expr is one expression: a command line with its continuation lines, a
+// blank line, or a malformed line, together with the comment lines that
+// precede it.
+type Expr struct {
+	// Comments holds the comment lines that precede the expression.
+	Comments []Line
+
+	// Head is the command line, blank line, or malformed line.
+	Head Line
+
+	// Continuations holds the lines that follow Head, each with its
+	// leading tab. For a malformed expression, it holds the indented lines
+	// skipped along with Head.
+	Continuations []Line
+
+	// Err is the *linebased.SyntaxError for a malformed expression,
+	// or nil.
+	Err error
+}
+
+// Parse parses src into a File.
+//
+// Parse always returns a complete File. Malformed lines are kept as
+// expressions with a non-nil Err, and the returned error is a
+// [linebased.ErrorList] of those errors, if any. Parse recovers from errors
+// the same way as a [linebased.Decoder] with recovery enabled.
+func Parse(src []byte) (*File, error) {
+	return parseLines(splitLines(src))
+}
+
+func parseLines(lines []Line) (*File, error) {
+	f := new(File)
+	var errs linebased.ErrorList
+	var comments []Line
+	var cur *Expr // last expression, if it can take indented lines
+	for _, l := range lines {
+		switch first := (l.Text + l.EOL)[0]; {
+		case first == '#':
+			comments = append(comments, l)
+			cur = nil
+		case first == '\t' && cur != nil && cur.Err == nil,
+			(first == ' ' || first == '\t') && cur != nil && cur.Err != nil:
+			cur.Continuations = append(cur.Continuations, l)
+		case first == ' ' || first == '\t':
+			err := &linebased.SyntaxError{
+				Line:    l.Pos.Line,
+				Span:    linebased.Span{Start: l.Pos, End: l.end()},
+				Message: "unexpected whitespace at start of line",
+			}
+			errs = append(errs, err)
+			cur = &Expr{Comments: comments, Head: l, Err: err}
+			f.Exprs = append(f.Exprs, cur)
+			comments = nil
+		default:
+			e := &Expr{Comments: comments, Head: l}
+			f.Exprs = append(f.Exprs, e)
+			comments = nil
+			cur = e
+			if first == '\n' {
+				cur = nil // blank lines have no continuations
+			}
+		}
+	}
+	f.Trailing = comments
+	if len(errs) > 0 {
+		return f, errs
+	}
+	return f, nil
+}
+
+// splitLines splits src into lines, recording their positions.
+func splitLines(src []byte) []Line {
+	var lines []Line
+	pos := linebased.Pos{Line: 1, Column: 1}
+	for len(src) > 0 {
+		var l Line
+		i := bytes.IndexByte(src, '\n')
+		switch {
+		case i < 0:
+			l.Text, src = string(src), nil
+		case i > 0 && src[i-1] == '\r':
+			l.Text, l.EOL, src = string(src[:i-1]), "\r\n", src[i+1:]
+		default:
+			l.Text, l.EOL, src = string(src[:i]), "\n", src[i+1:]
+		}
+		l.Pos = pos
+		lines = append(lines, l)
+		pos.Offset += len(l.Text) + len(l.EOL)
+		pos.Line++
+	}
+	return lines
+}
+
+// Bytes returns the source text of f.
+func (f *File) Bytes() []byte {
+	var b bytes.Buffer
+	f.WriteTo(&b)
+	return b.Bytes()
+}
+
+// WriteTo writes the source text of f to w.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, e := range f.Exprs {
+		m, err := e.WriteTo(w)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	m, err := writeLines(w, f.Trailing)
+	return n + m, err
+}
+
+// Bytes returns the source text of e.
+func (e *Expr) Bytes() []byte {
+	var b bytes.Buffer
+	e.WriteTo(&b)
+	return b.Bytes()
+}
+
+// WriteTo writes the source text of e to w.
+func (e *Expr) WriteTo(w io.Writer) (int64, error) {
+	return writeLines(w, e.lines())
+}
+
+func writeLines(w io.Writer, lines []Line) (int64, error) {
+	var n int64
+	for _, l := range lines {
+		m, err := io.WriteString(w, l.Text+l.EOL)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// lines returns every line of e in source order.
+func (e *Expr) lines() []Line {
+	lines := make([]Line, 0, len(e.Comments)+1+len(e.Continuations))
+	lines = append(lines, e.Comments...)
+	lines = append(lines, e.Head)
+	return append(lines, e.Continuations...)
+}
+
+// Name returns the command name of e, or the empty string for blank lines
+// and malformed expressions.
+func (e *Expr) Name() string {
+	if e.Err != nil {
+		return ""
+	}
+	name, _, _ := strings.Cut(e.Head.Text, " ")
+	name, _, _ = strings.Cut(name, "\t")
+	return strings.TrimSpace(name)
+}
+
+// Expression returns e as decoded by a [linebased.Decoder], with positions
+// that refer to the parsed source. For a malformed expression it returns the
+// zero Expression.
+func (e *Expr) Expression() linebased.Expression {
+	if e.Err != nil {
+		return linebased.Expression{}
+	}
+	lines := e.lines()
+	var b strings.Builder
+	writeLines(&b, lines)
+	expr, err := linebased.NewDecoder(strings.NewReader(b.String())).Decode()
+	if err != nil {
+		return linebased.Expression{}
+	}
+
+	// The decoder counted from the start of e; map back to the source.
+	pos := func(p linebased.Pos) linebased.Pos {
+		if p.Line < 1 || p.Line > len(lines) {
+			return p
+		}
+		l := lines[p.Line-1].Pos
+		return linebased.Pos{
+			Offset: l.Offset + p.Column - 1,
+			Line:   l.Line,
+			Column: l.Column + p.Column - 1,
+		}
+	}
+	span := func(s linebased.Span) linebased.Span {
+		if s == (linebased.Span{}) {
+			return s
+		}
+		return linebased.Span{Start: pos(s.Start), End: pos(s.End)}
+	}
+	expr.Line = e.Head.Pos.Line
+	expr.Span = span(expr.Span)
+	expr.NameSpan = span(expr.NameSpan)
+	expr.TailSpan = span(expr.TailSpan)
+	expr.CommentSpan = span(expr.CommentSpan)
+	for i, s := range expr.ContinuationSpans {
+		expr.ContinuationSpans[i] = span(s)
+	}
+	return expr
+}
+
+// Nested parses the continuation lines of e, without their leading tabs,
+// as a file of their own. This is how the body of a define is parsed.
+// Positions in the nested file refer to the source of e.
+//
+// The nested file is a copy; use [Expr.SetNested] to store edits to it
+// back into e.
+func (e *Expr) Nested() (*File, error) {
+	lines := make([]Line, len(e.Continuations))
+	for i, l := range e.Continuations {
+		lines[i] = l
+		if strings.HasPrefix(l.Text, "\t") {
+			lines[i].Text = l.Text[1:]
+			lines[i].Pos.Offset++
+			lines[i].Pos.Column++
+		}
+	}
+	return parseLines(lines)
+}
+
+// SetNested replaces the continuation lines of e with the lines of f,
+// each indented by a tab.
+func (e *Expr) SetNested(f *File) {
+	var lines []Line
+	for _, x := range f.Exprs {
+		lines = append(lines, x.lines()...)
+	}
+	lines = append(lines, f.Trailing...)
+	e.Continuations = e.Continuations[:0]
+	for _, l := range lines {
+		l.Text = "\t" + l.Text
+		e.Continuations = append(e.Continuations, l)
+	}
+}
+
+// SetName replaces the command name of e, leaving the rest of the line
+// unchanged. It returns an error if e is a blank line or malformed, and so
+// has no name, or if name is not a valid command name.
+func (e *Expr) SetName(name string) error {
+	old := e.Name()
+	if old == "" {
+		return errors.New("cst: SetName of an expression without a name")
+	}
+	if name == "" || name[0] == '#' || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("cst: invalid command name %q", name)
+	}
+	i := strings.Index(e.Head.Text, old)
+	e.Head.Text = e.Head.Text[:i] + name + e.Head.Text[i+len(old):]
+	return nil
+}
+
+// SetBody replaces the tail and continuation lines of e with body, written
+// as a [linebased.Encoder] would write it. The comments, the name, and the
+// line terminator style of e are kept.
+func (e *Expr) SetBody(body string) error {
+	x, err := NewExpr(linebased.Expression{Name: e.Name(), Body: body})
+	if err != nil {
+		return err
+	}
+	last := e.Head.EOL
+	if n := len(e.Continuations); n > 0 {
+		last = e.Continuations[n-1].EOL
+	}
+	eol := "\n"
+	if e.Head.EOL == "\r\n" {
+		eol = "\r\n"
+	}
+
+	e.Head.Text = x.Head.Text
+	e.Head.EOL = eol
+	e.Continuations = x.Continuations
+	for i := range e.Continuations {
+		e.Continuations[i].EOL = eol
+	}
+	if n := len(e.Continuations); n > 0 {
+		e.Continuations[n-1].EOL = last
+	} else {
+		e.Head.EOL = last
+	}
+	return nil
+}
+
+// NewExpr returns the expression that a [linebased.Encoder] writes for x.
+// Positions of its lines are relative to its own text.
+func NewExpr(x linebased.Expression) (*Expr, error) {
+	var b bytes.Buffer
+	if err := linebased.NewEncoder(&b).Encode(x); err != nil {
+		return nil, err
+	}
+	f, err := Parse(b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return f.Exprs[0], nil
+}
@@ -0,0 +1,251 @@
+package cst_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"blake.io/linebased"
+	"blake.io/linebased/cst"
+	"kr.dev/diff"
+)
+
+const tricky = "# leading comment\r\n" +
+	"define greet  name\r\n" +
+	"\techo hello,   $name\r\n" +
+	"\r\n" +
+	"greet\t world \r\n" +
+	"\n" +
+	"  indented\n" +
+	"\tskipped\n" +
+	"# trailing 1\n" +
+	"# trailing 2"
+
+func TestParseRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"\n",
+		"echo hi",
+		"echo hi\n",
+		"\n\n\n",
+		"# only a comment",
+		"cmd\n\tcont\n\t\n\tmore",
+		"a\r\nb\n\tc\r\n",
+		" bad\n\tbad too\nok\n",
+		tricky,
+	}
+	for _, src := range tests {
+		f, _ := cst.Parse([]byte(src))
+		if got := string(f.Bytes()); got != src {
+			t.Errorf("Parse(%q).Bytes() = %q", src, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	f, err := cst.Parse([]byte(tricky))
+
+	var list linebased.ErrorList
+	if !errors.As(err, &list) || len(list) != 1 {
+		t.Fatalf("err = %v; want ErrorList with one error", err)
+	}
+	var synErr *linebased.SyntaxError
+	if !errors.As(err, &synErr) || synErr.Line != 7 {
+		t.Fatalf("err = %v; want SyntaxError on line 7", err)
+	}
+
+	var got []string
+	for _, e := range f.Exprs {
+		got = append(got, e.Name())
+	}
+	want := []string{"define", "", "greet", "", ""}
+	diff.Test(t, t.Errorf, got, want)
+
+	if f.Exprs[4].Err != synErr {
+		t.Errorf("Exprs[4].Err = %v; want %v", f.Exprs[4].Err, synErr)
+	}
+	if n := len(f.Exprs[4].Continuations); n != 1 {
+		t.Errorf("malformed expression has %d continuation lines; want 1", n)
+	}
+	if n := len(f.Trailing); n != 2 {
+		t.Errorf("len(Trailing) = %d; want 2", n)
+	}
+
+	head := f.Exprs[2].Head
+	wantHead := cst.Line{
+		Pos:  linebased.Pos{Offset: 63, Line: 5, Column: 1},
+		Text: "greet\t world ",
+		EOL:  "\r\n",
+	}
+	diff.Test(t, t.Errorf, head, wantHead)
+}
+
+func TestExpression(t *testing.T) {
+	f, _ := cst.Parse([]byte(tricky))
+
+	// Expression must agree with a decoder reading the whole source.
+	d := linebased.NewDecoder(strings.NewReader(tricky))
+	d.SetRecover(true)
+	var want []linebased.Expression
+	for {
+		expr, err := d.Decode()
+		if err != nil {
+			break
+		}
+		want = append(want, expr)
+	}
+	want = want[:len(want)-1] // trailing comments
+
+	var got []linebased.Expression
+	for _, e := range f.Exprs {
+		if e.Err == nil {
+			got = append(got, e.Expression())
+		}
+	}
+	diff.Test(t, t.Errorf, got, want)
+}
+
+func TestEdit(t *testing.T) {
+	f, _ := cst.Parse([]byte(tricky))
+
+	if err := f.Exprs[0].SetName("def"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Exprs[2].SetBody("everyone\nand more"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# leading comment\r\n" +
+		"def greet  name\r\n" +
+		"\techo hello,   $name\r\n" +
+		"\r\n" +
+		"greet everyone\r\n" +
+		"\tand more\r\n" +
+		"\n" +
+		"  indented\n" +
+		"\tskipped\n" +
+		"# trailing 1\n" +
+		"# trailing 2"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("edited file:\ngot  %q\nwant %q", got, want)
+	}
+
+	if err := f.Exprs[2].SetBody(" leading space"); err == nil {
+		t.Error("SetBody with leading space: got nil error")
+	}
+
+	// Blank lines and malformed expressions have no name to replace.
+	for _, i := range []int{1, 4} {
+		e := f.Exprs[i]
+		before := e.Head.Text
+		if err := e.SetName("x"); err == nil {
+			t.Errorf("SetName on Exprs[%d] (%q): got nil error", i, before)
+		}
+		if e.Head.Text != before {
+			t.Errorf("SetName on Exprs[%d] changed the line to %q", i, e.Head.Text)
+		}
+	}
+	if err := f.Exprs[0].SetName("two words"); err == nil {
+		t.Error("SetName with a space: got nil error")
+	}
+}
+
+func TestNested(t *testing.T) {
+	src := "define outer\n" +
+		"\tdefine inner x\n" +
+		"\t\techo $x\n" +
+		"\tinner  1\n"
+	f, _ := cst.Parse([]byte(src))
+	def := f.Exprs[0]
+
+	body, err := def.Nested()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(body.Exprs); n != 2 {
+		t.Fatalf("nested file has %d expressions; want 2", n)
+	}
+
+	call := body.Exprs[1].Expression()
+	wantSpan := linebased.Span{
+		Start: linebased.Pos{Offset: 40, Line: 4, Column: 2},
+		End:   linebased.Pos{Offset: 45, Line: 4, Column: 7},
+	}
+	if call.NameSpan != wantSpan {
+		t.Errorf("NameSpan = %+v; want %+v", call.NameSpan, wantSpan)
+	}
+	if got := src[call.NameSpan.Start.Offset:call.NameSpan.End.Offset]; got != "inner" {
+		t.Errorf("NameSpan covers %q; want %q", got, "inner")
+	}
+
+	body.Exprs[0].Head.Text = "define renamed x"
+	if err := body.Exprs[1].SetName("renamed"); err != nil {
+		t.Fatal(err)
+	}
+	def.SetNested(body)
+	want := "define outer\n" +
+		"\tdefine renamed x\n" +
+		"\t\techo $x\n" +
+		"\trenamed  1\n"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("edited file:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestNewExpr(t *testing.T) {
+	e, err := cst.NewExpr(linebased.Expression{
+		Comment: "# say it\n",
+		Name:    "echo",
+		Body:    "one\ntwo\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(e.Bytes()), "# say it\necho one\n\ttwo\n"; got != want {
+		t.Errorf("Bytes() = %q; want %q", got, want)
+	}
+
+	if _, err := cst.NewExpr(linebased.Expression{Name: "two words"}); err == nil {
+		t.Error("NewExpr with invalid name: got nil error")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(tricky)
+	f.Add("a\n\tb\n#c\n\td\n")
+	f.Add("\r\n\tx\r\n")
+	f.Fuzz(func(t *testing.T, src string) {
+		file, err := cst.Parse([]byte(src))
+		if got := string(file.Bytes()); got != src {
+			t.Fatalf("round trip:\ngot  %q\nwant %q", got, src)
+		}
+
+		d := linebased.NewDecoder(strings.NewReader(src))
+		d.SetRecover(true)
+		want := []linebased.Expression{}
+		var derr error
+		for {
+			expr, err := d.Decode()
+			if err != nil {
+				derr = err
+				break
+			}
+			want = append(want, expr)
+		}
+		if len(file.Trailing) > 0 {
+			want = want[:len(want)-1]
+		}
+		if (err == nil) != (derr == io.EOF) {
+			t.Fatalf("Parse error = %v; decoder error = %v", err, derr)
+		}
+
+		got := []linebased.Expression{}
+		for _, e := range file.Exprs {
+			if e.Err == nil {
+				got = append(got, e.Expression())
+			}
+		}
+		diff.Test(t, t.Fatalf, got, want)
+	})
+}
@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"strings"
 )
 
 // SyntaxError represents a syntax error in the input.
 type SyntaxError struct {
 	Line    int    // line number (1-indexed)
+	Span    Span   // offending line, excluding its line terminator
 	Message string // error message without line prefix
 	Err     error  // underlying error, if any
 }
@@ -23,8 +25,45 @@ func (e *SyntaxError) Unwrap() error {
 	return e.Err
 }
 
+// ErrorList is a list of errors, in the order they were found.
+// It supports [errors.Is] and [errors.As] by unwrapping to its elements.
+type ErrorList []error
+
+// Error reports each error on its own line.
+func (l ErrorList) Error() string {
+	var b strings.Builder
+	for i, err := range l {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+func (l ErrorList) Unwrap() []error {
+	return l
+}
+
+// Pos is a position in the input of a [Decoder].
+type Pos struct {
+	Offset int // byte offset (0-indexed)
+	Line   int // line number (1-indexed)
+	Column int // byte offset within the line (1-indexed)
+}
+
+// Span is the half-open range of input from Start up to, but not including, End.
+type Span struct {
+	Start, End Pos
+}
+
 // Expression represents a line-based expression consisting of an optional command
 // with continuation lines, preceded by zero or more comment lines.
+//
+// The spans are relative to the input of the [Decoder] that produced the
+// expression. Like Line, for expressions expanded from a template they are
+// relative to the template body, and they locate the text before parameter
+// substitution. No span includes a line terminator.
 type Expression struct {
 	// Line is the line number where the expression body starts (1-indexed).
 	// This is the line number of the command or blank line, not the preceding comments.
@@ -42,6 +81,22 @@ type Expression struct {
 	// Body is everything in the expression after the command name,
 	// including continuation lines, each without their leading tab.
 	Body string
+
+	// Span covers the command line through the last continuation line.
+	Span Span
+
+	// NameSpan covers the command name.
+	NameSpan Span
+
+	// TailSpan covers the text following the name on the command line,
+	// without the whitespace that separates them.
+	TailSpan Span
+
+	// ContinuationSpans covers each continuation line, without its leading tab.
+	ContinuationSpans []Span
+
+	// CommentSpan covers the leading comment lines, if any.
+	CommentSpan Span
 }
 
 // ParseArgs splits the tail into at most n whitespace-separated arguments.
@@ -53,8 +108,13 @@ func (e Expression) ParseArgs(n int) Args {
 
 // Decoder reads line-based expressions from an input stream.
 type Decoder struct {
-	r    *bufio.Reader
-	line int // current line number (1-indexed)
+	r          *bufio.Reader
+	line       int // current line number (1-indexed)
+	lineOffset int // byte offset of the current line
+	offset     int // byte offset of the next line
+
+	recovering bool      // skip malformed lines instead of failing
+	errs       ErrorList // syntax errors skipped while recovering
 }
 
 // NewDecoder creates a new Decoder that reads from r.
@@ -62,12 +122,23 @@ func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{r: bufio.NewReader(r)}
 }
 
+// SetRecover controls whether the decoder recovers from syntax errors.
+//
+// When recovering, Decode records a [*SyntaxError] for each malformed line,
+// skips that line and any indented lines that follow it, and continues with
+// the next command. At the end of the input, Decode returns the recorded
+// errors as an [ErrorList] in place of io.EOF.
+func (d *Decoder) SetRecover(on bool) {
+	d.recovering = on
+}
+
 // Decode reads the next Expression from the input and returns it.
 // It returns io.EOF when there are no more expressions to read.
 // It returns an error if the input is malformed.
 func (d *Decoder) Decode() (Expression, error) {
 	var comments strings.Builder
 	var body strings.Builder
+	var commentSpan Span
 
 	for {
 		line, err := d.readLine()
@@ -80,32 +151,76 @@ func (d *Decoder) Decode() (Expression, error) {
 				// The next call to Decode will return the sticky err.
 				c := comments.String()
 				exprLine := d.line
+				end := d.pos(0)
 				if !strings.HasSuffix(c, "\n") {
 					// Content without trailing newline stays on its line.
 					exprLine--
+					end = commentSpan.End
 				}
-				return makeExpr(exprLine, c, body.String()), nil
+				expr := makeExpr(exprLine, c, body.String())
+				expr.Span = Span{end, end}
+				expr.NameSpan = expr.Span
+				expr.TailSpan = expr.Span
+				expr.CommentSpan = commentSpan
+				return expr, nil
+			}
+			if d.recovering && len(d.errs) > 0 && errors.Is(err, io.EOF) {
+				return Expression{}, d.errs
 			}
 			return Expression{}, err
 		}
 
 		switch line[0] {
 		case '\n':
-			return makeExpr(d.line, comments.String(), line), nil
+			expr := makeExpr(d.line, comments.String(), line)
+			start := d.pos(0)
+			expr.Span = Span{start, start}
+			expr.NameSpan = expr.Span
+			expr.TailSpan = expr.Span
+			expr.CommentSpan = commentSpan
+			return expr, nil
 		case '#':
+			if comments.Len() == 0 {
+				commentSpan.Start = d.pos(0)
+			}
+			commentSpan.End = d.pos(lineEnd(line))
 			comments.WriteString(line)
 			if err != nil && !errors.Is(err, io.EOF) {
 				return Expression{}, err
 			}
 		case ' ', '\t':
-			return Expression{}, &SyntaxError{
+			synErr := &SyntaxError{
 				Line:    d.line,
+				Span:    Span{d.pos(0), d.pos(lineEnd(line))},
 				Message: "unexpected whitespace at start of line",
 			}
+			if !d.recovering {
+				return Expression{}, synErr
+			}
+			d.errs = append(d.errs, synErr)
+			if err := d.skipIndented(); err != nil {
+				return Expression{}, err
+			}
+			// Comments before a malformed line belong to it.
+			comments.Reset()
+			commentSpan = Span{}
 		default:
 			body.WriteString(line)
 			startingLine := d.line
 
+			// Locate the name and inline tail on the command line.
+			name, _ := parseBody(line)
+			nameStart := strings.Index(line, name)
+			tailStart, end := nameStart+len(name), lineEnd(line)
+			for tailStart < end && (line[tailStart] == ' ' || line[tailStart] == '\t') {
+				tailStart++
+			}
+			tailStart = min(tailStart, end)
+			span := Span{d.pos(0), d.pos(end)}
+			nameSpan := Span{d.pos(nameStart), d.pos(nameStart + len(name))}
+			tailSpan := Span{d.pos(tailStart), d.pos(end)}
+			var contSpans []Span
+
 			// Read continuation lines, if any.
 			for {
 				b, err := d.peek()
@@ -120,12 +235,69 @@ func (d *Decoder) Decode() (Expression, error) {
 					return Expression{}, err
 				}
 				body.WriteString(line[1:]) // strip leading tab
+				end := d.pos(max(1, lineEnd(line)))
+				contSpans = append(contSpans, Span{d.pos(1), end})
+				span.End = end
 				if errors.Is(err, io.EOF) {
 					break
 				}
 			}
 
-			return makeExpr(startingLine, comments.String(), body.String()), nil
+			expr := makeExpr(startingLine, comments.String(), body.String())
+			expr.Span = span
+			expr.NameSpan = nameSpan
+			expr.TailSpan = tailSpan
+			expr.ContinuationSpans = contSpans
+			expr.CommentSpan = commentSpan
+			return expr, nil
+		}
+	}
+}
+
+// Expressions returns an iterator over the expressions read from r.
+// Iteration stops after the first error, which is yielded with a zero
+// Expression. Reaching the end of input is not an error.
+//
+//	for expr, err := range linebased.Expressions(r) {
+//		if err != nil {
+//			return err
+//		}
+//		// process expr
+//	}
+func Expressions(r io.Reader) iter.Seq2[Expression, error] {
+	return func(yield func(Expression, error) bool) {
+		dec := NewDecoder(r)
+		for {
+			expr, err := dec.Decode()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(Expression{}, err)
+				return
+			}
+			if !yield(expr, nil) {
+				return
+			}
+		}
+	}
+}
+
+// skipIndented consumes lines that start with a space or tab.
+func (d *Decoder) skipIndented() error {
+	for {
+		b, err := d.peek()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b != ' ' && b != '\t' {
+			return nil
+		}
+		if _, err := d.readLine(); err != nil && !errors.Is(err, io.EOF) {
+			return err
 		}
 	}
 }
@@ -161,8 +333,24 @@ func (d *Decoder) peek() (byte, error) {
 	return b[0], nil
 }
 
-// readLine reads the next line from the input, updating the line counter.
+// readLine reads the next line from the input, updating the line counter
+// and byte offsets.
 func (d *Decoder) readLine() (string, error) {
 	d.line++
-	return d.r.ReadString('\n')
+	d.lineOffset = d.offset
+	line, err := d.r.ReadString('\n')
+	d.offset += len(line)
+	return line, err
+}
+
+// pos returns the position of the byte at index i of the current line.
+func (d *Decoder) pos(i int) Pos {
+	return Pos{Offset: d.lineOffset + i, Line: d.line, Column: i + 1}
+}
+
+// lineEnd returns the length of line without its line terminator.
+func lineEnd(line string) int {
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return len(line)
 }
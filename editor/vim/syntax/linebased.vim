@@ -15,13 +15,16 @@ syn match linebasedComment "^#.*$"
 syn match linebasedVariable "\$\w\+"
 syn match linebasedVariable "\${[^}]\+}"
 
+" $$ is a literal dollar sign
+syn match linebasedEscape "\$\$"
+
 " Continuation lines (body of any expression) - just text with variables
 " Note: LSP semantic tokens provide context-aware highlighting for template bodies
-syn match linebasedContinuation "^\t.*$" contains=linebasedVariable
+syn match linebasedContinuation "^\t.*$" contains=linebasedVariable,linebasedEscape
 
-" Builtin commands: define and include
+" Builtin commands: define, include, and include?
 syn match linebasedDefine "^define\>" nextgroup=linebasedTemplateName skipwhite
-syn match linebasedInclude "^include\>"
+syn match linebasedInclude "^include\%(?\|\>\)"
 
 " Template name after define
 syn match linebasedTemplateName "\S\+" contained nextgroup=linebasedParameter skipwhite
@@ -40,6 +43,7 @@ hi def link linebasedInclude Keyword
 hi def link linebasedTemplateName Function
 hi def link linebasedParameter Identifier
 hi def link linebasedVariable Special
+hi def link linebasedEscape SpecialChar
 hi def link linebasedCommand Statement
 
 " Sync from start of line - linebased is line-oriented
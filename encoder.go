@@ -0,0 +1,92 @@
+package linebased
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encoder writes expressions to an output stream as linebased source.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes expr to the stream in canonical form: the comment lines,
+// then the name, a single space, and the first line of the body on the
+// command line, then each remaining body line as a tab-indented
+// continuation line. An expression with an empty name is written as a
+// blank line.
+//
+// Decoding the output yields an expression with the same Comment, Name, and
+// Body. Every expression is terminated by a newline, so a Body or Comment
+// without a trailing newline is written as if it had one, and an empty Body
+// is written as "\n".
+//
+// Encode returns an error without writing anything if expr cannot be
+// represented: the name contains a space, tab, or newline, begins or ends
+// with whitespace, or starts with '#'; a comment line does not start with
+// '#'; the body begins with a space or tab; or an expression without a name
+// has a body.
+func (e *Encoder) Encode(expr Expression) error {
+	if err := validate(expr); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if expr.Comment != "" {
+		b.WriteString(expr.Comment)
+		if !strings.HasSuffix(expr.Comment, "\n") {
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString(expr.Name)
+
+	body := strings.TrimSuffix(expr.Body, "\n")
+	head, rest, multiline := strings.Cut(body, "\n")
+	if head != "" {
+		b.WriteByte(' ')
+		b.WriteString(head)
+	}
+	b.WriteByte('\n')
+	if multiline {
+		for line := range strings.SplitSeq(rest, "\n") {
+			b.WriteByte('\t')
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+// validate reports whether expr can be encoded so that it decodes unchanged.
+func validate(expr Expression) error {
+	for line := range strings.SplitSeq(strings.TrimSuffix(expr.Comment, "\n"), "\n") {
+		if expr.Comment != "" && !strings.HasPrefix(line, "#") {
+			return fmt.Errorf("encode: comment line %q does not start with '#'", line)
+		}
+	}
+	if expr.Name == "" {
+		if expr.Body != "" && expr.Body != "\n" {
+			return errors.New("encode: expression without a name has a body")
+		}
+		return nil
+	}
+	if strings.HasPrefix(expr.Name, "#") {
+		return fmt.Errorf("encode: name %q starts with '#'", expr.Name)
+	}
+	if strings.ContainsAny(expr.Name, " \t\n") || strings.TrimSpace(expr.Name) != expr.Name {
+		return fmt.Errorf("encode: name %q contains whitespace", expr.Name)
+	}
+	if strings.HasPrefix(expr.Body, " ") || strings.HasPrefix(expr.Body, "\t") {
+		return fmt.Errorf("encode: body of %q begins with whitespace", expr.Name)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package linebased
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors reported by an [ExpandingDecoder] as the Err of an
+// [ExpressionError]. Test for them with [errors.Is].
+var (
+	// ErrRecursion reports a template that calls itself, directly or
+	// through other templates.
+	ErrRecursion = errors.New("recursion detected")
+
+	// ErrNestedDefine reports a template whose expansion contains a define.
+	ErrNestedDefine = errors.New("illegal nested define")
+)
+
+// An ArityError reports a template call with too few arguments.
+type ArityError struct {
+	Template string
+	Want     int  // number of required parameters
+	Got      int  // number of arguments given
+	AtLeast  bool // the template also has optional or variadic parameters
+}
+
+func (e *ArityError) Error() string {
+	if e.AtLeast {
+		return fmt.Sprintf("template %q expects at least %d arguments, got %d", e.Template, e.Want, e.Got)
+	}
+	return fmt.Sprintf("template %q expects %d arguments, got %d", e.Template, e.Want, e.Got)
+}
+
+// An UnknownParameterError reports a reference in a template body to a name
+// that is not a parameter of the template.
+type UnknownParameterError struct {
+	Template string
+	Name     string // the referenced name, without $ or braces
+}
+
+func (e *UnknownParameterError) Error() string {
+	return fmt.Sprintf("unknown parameter reference: %q", e.Name)
+}
+
+// An IncludeCycleError reports a file that includes itself, directly or
+// through other files.
+type IncludeCycleError struct {
+	// Chain lists the files being included, from the first file read to
+	// the file included again, which also appears earlier in Chain.
+	Chain []string
+}
+
+func (e *IncludeCycleError) Error() string {
+	return "include cycle detected: " + strings.Join(e.Chain, " -> ")
+}
+
+// A RedefinitionError reports a define of a template that is already
+// defined.
+type RedefinitionError struct {
+	Template string
+
+	// Previous is the define expression of the earlier template. For a
+	// template added by [ExpandingDecoder.DefineFunc], Func is true and
+	// Previous holds the declaration, without a file.
+	Previous Expanded
+	Func     bool
+}
+
+func (e *RedefinitionError) Error() string {
+	if e.Func {
+		return fmt.Sprintf("template %q redefined; previously defined by DefineFunc", e.Template)
+	}
+	return fmt.Sprintf("template %q redefined; previous define: %s:%d", e.Template, e.Previous.File, e.Previous.Line)
+}
+
+// A LimitError reports an expansion that breached one of the [Limits] set
+// with [ExpandingDecoder.SetLimits]. Its message includes the template
+// call stack.
+type LimitError struct {
+	Limit string // name of the breached field of Limits, such as "MaxCallDepth"
+	Value int64  // value of the limit
+
+	msg string
+}
+
+func (e *LimitError) Error() string {
+	return e.msg
+}
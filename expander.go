@@ -1,11 +1,14 @@
 package linebased
 
 import (
+	"cmp"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
-	"os"
+	"iter"
 	"path"
 	"slices"
 	"strings"
@@ -13,6 +16,7 @@ import (
 
 // ExpressionError reports an error that occurred while expanding or executing a
 // linebased expression along with the expression that caused it.
+// The spans of the embedded [Expression] locate the text that failed.
 type ExpressionError struct {
 	Expanded       // The expression where the error occurred.
 	Err      error // The error.
@@ -34,51 +38,90 @@ func (e *ExpressionError) Unwrap() error {
 // Create an ExpandingDecoder with [NewExpandingDecoder], then call [ExpandingDecoder.Decode]
 // repeatedly until it returns [io.EOF].
 type ExpandingDecoder struct {
-	fsys fs.FS
-	defs map[string]template
-	root string // prefix for file paths in error messages
-
-	// decoderStack holds nested decoders for includes.
-	// The last element is the current decoder.
+	fsys     fs.FS
+	resolver Resolver // finds included files; see SetResolver
+	defs     map[defKey]template
+	root     string // prefix for file paths in error messages
+
+	// decoderStack holds nested decoders for includes and the bodies of
+	// template calls being expanded. The last element is the current
+	// decoder.
 	decoderStack []decoderFrame
 
-	// pending holds expressions waiting to be returned.
-	// Used when template expansion produces multiple expressions.
-	pending []Expanded
-
 	// callStack tracks template expansion for debugging and cycle detection.
 	callStack stack
 
-	// includeStack tracks included files for cycle detection.
+	// includeStack holds the identities of the files being read, as
+	// returned by the resolver, for cycle detection. The last element is
+	// the current file.
 	includeStack []string
 
+	// set holds templates shared with other decoders; see SetTemplates.
+	set *TemplateSet
+
+	// building reports whether the decoder is parsing files into set.
+	building bool
+
+	// limits bounds expansion; see SetLimits.
+	limits Limits
+
+	// produced counts the expressions produced, for Limits.MaxExpressions.
+	produced int
+
+	// calls counts the template calls and includes, for Limits.MaxCalls.
+	calls int
+
+	recovering bool      // see SetRecover
+	errs       ErrorList // errors skipped while recovering
+
 	// err is a sticky error; once set, Decode returns it forever.
 	err error
 }
 
-// decoderFrame holds a decoder and its associated file name.
+// decoderFrame holds a decoder and its associated file name, or the body of
+// a template call.
 type decoderFrame struct {
-	dec  *Decoder
-	file string
+	dec     *Decoder
+	file    string
+	f       io.Closer   // underlying file, closed when the frame is popped
+	include Expanded    // the include expression that opened file, if any
+	sum     hash.Hash   // hash of the file read so far, when building a template set
+	info    fs.FileInfo // of the file, if known, when building a template set
+
+	body *bodyExpander // for template calls; the other fields are unset
 }
 
 // NewExpandingDecoder creates an ExpandingDecoder that reads from the named file
 // in fsys, expanding any templates defined in-line.
 //
 // Include paths are rooted at fsys. For example, if main.lb contains
-// "include lib/utils.lb", the decoder opens "lib/utils.lb" from fsys directly.
-// There is no relative path resolution - all includes are absolute paths
-// within the filesystem.
+// "include lib/utils", the decoder opens "lib/utils.linebased" from fsys
+// directly. There is no relative path resolution - all includes are absolute
+// paths within the filesystem. See [ExpandingDecoder.SetIncludePath] to
+// search other file systems as well, and [ExpandingDecoder.SetResolver] to
+// find included files some other way.
 //
 // Expressions with names that do not match a template are passed through as-is.
 // Invalid expansions are reported as [ExpressionError].
 func NewExpandingDecoder(name string, fsys fs.FS) *ExpandingDecoder {
+	return newExpandingDecoder(name, fsys, nil)
+}
+
+// newExpandingDecoder is like NewExpandingDecoder, but if set is not nil the
+// decoder parses the named file into set.
+func newExpandingDecoder(name string, fsys fs.FS, set *TemplateSet) *ExpandingDecoder {
 	d := &ExpandingDecoder{
-		fsys: fsys,
-		defs: make(map[string]template),
+		fsys:     fsys,
+		resolver: FSResolver(fsys),
+		defs:     make(map[defKey]template),
+	}
+	if set != nil {
+		d.defs = set.defs
+		d.set = set
+		d.building = true
 	}
 
-	f, err := openRoot(fsys, name)
+	f, id, err := openRoot(fsys, name)
 	if err != nil {
 		d.err = &ExpressionError{
 			Expanded: Expanded{Expression: Expression{Line: 1}, File: name},
@@ -87,11 +130,37 @@ func NewExpandingDecoder(name string, fsys fs.FS) *ExpandingDecoder {
 		return d
 	}
 
-	d.decoderStack = []decoderFrame{{dec: NewDecoder(f), file: name}}
-	d.includeStack = []string{name}
+	d.decoderStack = []decoderFrame{d.fileFrame(name, f, f, Expanded{})}
+	d.includeStack = []string{id}
 	return d
 }
 
+// Expand returns an iterator over the expanded expressions of the named file
+// in fsys. It is a convenience wrapper around [NewExpandingDecoder].
+//
+// Iteration stops after the first error, which is yielded with a zero
+// [Expanded]. Files opened by the expansion are closed when iteration ends,
+// including when the loop body breaks early.
+func Expand(name string, fsys fs.FS) iter.Seq2[Expanded, error] {
+	return func(yield func(Expanded, error) bool) {
+		d := NewExpandingDecoder(name, fsys)
+		defer d.close()
+		for {
+			expr, err := d.Decode()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(Expanded{}, err)
+				return
+			}
+			if !yield(expr, nil) {
+				return
+			}
+		}
+	}
+}
+
 // SetRoot sets a prefix for file paths in error messages. This is useful when
 // the fsys is rooted at a subdirectory but you want error messages to show
 // paths relative to a parent directory (e.g., the module root).
@@ -103,6 +172,29 @@ func (d *ExpandingDecoder) SetRoot(root string) {
 	d.root = root
 }
 
+// SetRecover controls whether the decoder recovers from errors.
+//
+// When recovering, Decode records each error, skips the expression that
+// caused it, and continues. An error in the body of a template, such as a
+// reference to an unknown parameter, skips the rest of that template's
+// expansion. At the end of the input, Decode returns the recorded errors as
+// an [ErrorList] in place of io.EOF, sorted by the file and line of the
+// expression in the input that caused them.
+//
+// Errors that breach the [Limits] and errors reading files are not
+// recovered. Decode returns them at once, with the errors recorded so far,
+// as an ErrorList.
+//
+// SetRecover must be called before the first call to Decode.
+func (d *ExpandingDecoder) SetRecover(on bool) {
+	d.recovering = on
+	for _, frame := range d.decoderStack {
+		if frame.dec != nil {
+			frame.dec.SetRecover(on)
+		}
+	}
+}
+
 func (d *ExpandingDecoder) filePath(name string) string {
 	return path.Join(d.root, name)
 }
@@ -111,237 +203,387 @@ func (d *ExpandingDecoder) filePath(name string) string {
 // It returns [io.EOF] when there are no more expressions.
 // After Decode returns an error (other than io.EOF), subsequent calls
 // return the same error.
+//
+// Templates are expanded lazily: Decode returns each expression as soon as
+// it is produced, and the decoder holds only the state of the calls and
+// includes in progress.
 func (d *ExpandingDecoder) Decode() (Expanded, error) {
 	if d.err != nil {
 		return Expanded{}, d.err
 	}
 
 	for {
-		// Return pending expressions first (from template expansion).
-		if len(d.pending) > 0 {
-			expr := d.pending[0]
-			d.pending = d.pending[1:]
-			return expr, nil
-		}
-
 		// No current decoder means we're done.
 		if len(d.decoderStack) == 0 {
 			d.err = io.EOF
-			return Expanded{}, io.EOF
+			if len(d.errs) > 0 {
+				d.err = sortErrors(d.errs)
+			}
+			return Expanded{}, d.err
 		}
 
-		// Read from current decoder.
+		// Read from the current file or template body.
 		frame := &d.decoderStack[len(d.decoderStack)-1]
-		rawExpr, err := frame.dec.Decode()
+		inBody := frame.body != nil
+		expr, err := d.next(frame)
 		if errors.Is(err, io.EOF) {
-			// Pop this decoder and continue with parent.
-			d.decoderStack = d.decoderStack[:len(d.decoderStack)-1]
-			d.popInclude()
+			// Pop this decoder and continue with its parent.
+			d.popDecoder()
 			continue
 		}
 		if err != nil {
-			var synErr *SyntaxError
-			if errors.As(err, &synErr) {
-				d.err = &ExpressionError{
-					Expanded: Expanded{Expression: Expression{Line: synErr.Line}, File: d.filePath(frame.file)},
-					Err:      errors.New(synErr.Message),
+			if d.recovered(err) {
+				if inBody {
+					d.popDecoder() // skip the rest of the expansion
 				}
-			} else {
-				d.err = err
+				continue
 			}
-			return Expanded{}, d.err
+			return Expanded{}, d.fail(err)
 		}
 
-		expr := Expanded{
-			Expression: rawExpr,
-			File:       d.filePath(frame.file),
+		// Handle the expression (may push a new decoder).
+		result, ok, err := d.expand(expr)
+		if err != nil {
+			if d.recovered(err) {
+				continue // skip the expression
+			}
+			return Expanded{}, d.fail(err)
+		}
+		if ok {
+			if inBody && len(result.Stack) == 0 {
+				result.Stack = d.callStack.framesCopy()
+			}
+			return result, nil
 		}
+		// expand handled the expression internally (e.g., define, include,
+		// or a template call). Loop to get the next one.
+	}
+}
 
-		// Handle the expression (may populate d.pending).
-		result, err := d.expand(expr)
+// next returns the next expression read from frame, or io.EOF when the
+// frame is exhausted.
+func (d *ExpandingDecoder) next(frame *decoderFrame) (Expanded, error) {
+	if b := frame.body; b != nil {
+		expr, err := b.next()
 		if err != nil {
-			d.err = err
 			return Expanded{}, err
 		}
-		if result != nil {
-			return *result, nil
+		if expr.Name == "define" {
+			return Expanded{}, &ExpressionError{
+				Expanded: b.call,
+				Err:      fmt.Errorf("expansion of %q contains %w: %q", b.t.name, ErrNestedDefine, expr.String()),
+			}
+		}
+		return expr, nil
+	}
+
+	rawExpr, err := frame.dec.Decode()
+	if err != nil {
+		var list ErrorList
+		if errors.As(err, &list) {
+			// Syntax errors skipped by a recovering decoder.
+			for _, err := range list {
+				d.recovered(d.syntaxError(frame, err))
+			}
+			return Expanded{}, io.EOF
+		}
+		var synErr *SyntaxError
+		switch {
+		case errors.As(err, &synErr):
+			return Expanded{}, d.syntaxError(frame, synErr)
+		case errors.Is(err, errIncludeTooLarge):
+			return Expanded{}, d.includeSizeError(frame.include, d.limits.MaxIncludeBytes)
 		}
-		// expand returned nil, meaning it handled the expression internally
-		// (e.g., define or include). Loop to get the next one.
+		return Expanded{}, err
+	}
+	return Expanded{
+		Expression: rawExpr,
+		File:       d.filePath(frame.file),
+	}, nil
+}
+
+// syntaxError returns an ExpressionError for a *SyntaxError in the file
+// read by frame.
+func (d *ExpandingDecoder) syntaxError(frame *decoderFrame, err error) error {
+	synErr, ok := err.(*SyntaxError)
+	if !ok {
+		return err
+	}
+	return &ExpressionError{
+		Expanded: Expanded{Expression: Expression{Line: synErr.Line, Span: synErr.Span}, File: d.filePath(frame.file)},
+		Err:      errors.New(synErr.Message),
 	}
 }
 
 // expand processes a single expression, handling builtins and template expansion.
-// Returns the expression to yield, or nil if the expression was handled internally.
-// May populate d.pending with additional expressions from template expansion.
-func (d *ExpandingDecoder) expand(expr Expanded) (*Expanded, error) {
+// Returns the expression to yield and true, or false if the expression was
+// handled internally.
+// Includes and template calls push a decoder for the included file or the
+// template body onto the decoder stack.
+func (d *ExpandingDecoder) expand(expr Expanded) (Expanded, bool, error) {
+	if err := d.checkSize(expr); err != nil {
+		return Expanded{}, false, err
+	}
+
 	switch expr.Name {
 	case "define":
 		if err := d.define(expr); err != nil {
-			return nil, &ExpressionError{Expanded: expr, Err: err}
+			return Expanded{}, false, &ExpressionError{Expanded: expr, Err: err}
 		}
-		return nil, nil
+		return Expanded{}, false, nil
 
-	case "include":
+	case "include", "include?":
 		includePath := ParseArgs(expr.Body, 1).At(0)
 		if includePath == "" {
-			return nil, &ExpressionError{Expanded: expr, Err: errors.New("include: missing filename")}
+			return Expanded{}, false, &ExpressionError{Expanded: expr, Err: fmt.Errorf("%s: missing filename", expr.Name)}
 		}
-		if strings.Contains(includePath, "/") {
-			return nil, &ExpressionError{Expanded: expr, Err: fmt.Errorf("include: path %q contains '/'; only root-level includes are allowed", includePath)}
+		if !fs.ValidPath(includePath) || includePath == "." {
+			return Expanded{}, false, &ExpressionError{Expanded: expr, Err: fmt.Errorf("%s: invalid path %q; paths are relative to the include root and may not contain \".\", \"..\", or empty elements", expr.Name, includePath)}
 		}
 		if strings.HasSuffix(includePath, ".linebased") {
-			return nil, &ExpressionError{Expanded: expr, Err: fmt.Errorf("include: path %q has .linebased extension; the extension is not required and will be added automatically", includePath)}
+			return Expanded{}, false, &ExpressionError{Expanded: expr, Err: fmt.Errorf("%s: path %q has .linebased extension; the extension is not required and will be added automatically", expr.Name, includePath)}
+		}
+
+		if err := d.countCall(expr); err != nil {
+			return Expanded{}, false, err
 		}
 
 		// Add .linebased extension
 		includePath += ".linebased"
 
-		if !d.pushInclude(includePath) {
-			return nil, &ExpressionError{
-				Expanded: expr,
-				Err:      fmt.Errorf("include cycle detected: %s", d.includeCycle(includePath)),
+		// Files in the template set are already defined. The set may
+		// have been parsed from another file system, so a file missing
+		// here is taken from the set, and a file found here must be the
+		// one in the set.
+		id, f, err := d.resolver.Resolve(includePath, d.includeStack[len(d.includeStack)-1])
+		if err != nil {
+			if _, ok := d.setFile(includePath); ok && errors.Is(err, fs.ErrNotExist) {
+				return Expanded{}, false, nil
+			}
+			if expr.Name == "include?" && errors.Is(err, fs.ErrNotExist) {
+				return Expanded{}, false, nil // optional and absent
 			}
+			return Expanded{}, false, &ExpressionError{Expanded: expr, Err: err}
+		}
+		if sum, ok := d.setFile(id, includePath); ok {
+			err := d.checkSetFile(expr, id, f, sum)
+			f.Close()
+			return Expanded{}, false, err
 		}
 
-		f, err := d.fsys.Open(includePath)
-		if err != nil {
+		if !d.pushInclude(id) {
+			f.Close()
+			return Expanded{}, false, &ExpressionError{
+				Expanded: expr,
+				Err:      &IncludeCycleError{Chain: append(slices.Clone(d.includeStack), id)},
+			}
+		}
+		if err := d.checkInclude(expr, f); err != nil {
+			f.Close()
 			d.popInclude()
-			return nil, &ExpressionError{Expanded: expr, Err: err}
+			return Expanded{}, false, err
+		}
+		var r io.Reader = f
+		if limit := d.limits.MaxIncludeBytes; limit > 0 {
+			r = &limitReader{r: f, n: limit}
 		}
 
 		// Push new decoder onto stack.
-		d.decoderStack = append(d.decoderStack, decoderFrame{dec: NewDecoder(f), file: includePath})
-		return nil, nil
+		d.decoderStack = append(d.decoderStack, d.fileFrame(id, r, f, expr))
+		return Expanded{}, false, nil
 
 	case "":
 		// Blank or comment-only line; pass through.
-		return &expr, nil
+		if err := d.count(expr); err != nil {
+			return Expanded{}, false, err
+		}
+		return expr, true, nil
 	}
 
 	// Check for template match.
-	t, ok := d.defs[expr.Name]
-	if !ok || t.body == "" {
+	t, ok := d.lookup(expr.Name, d.scope())
+	if !ok && isPrivate(expr.Name) {
+		if file, ok := d.privateFile(expr.Name); ok {
+			return Expanded{}, false, &ExpressionError{
+				Expanded: expr,
+				Err:      fmt.Errorf("template %q is private to %s", expr.Name, d.filePath(file)),
+			}
+		}
+	}
+	if !ok || (t.body == "" && t.fn == nil) {
 		// No matching template or empty template; pass through.
 		expr.Stack = d.callStack.framesCopy()
-		return &expr, nil
+		if err := d.count(expr); err != nil {
+			return Expanded{}, false, err
+		}
+		return expr, true, nil
 	}
 
 	// Expand template.
-	return d.expandTemplate(t, expr)
+	return Expanded{}, false, d.expandTemplate(t, expr)
 }
 
-// expandTemplate expands a template call, returning the first expression
-// and queuing any additional expressions in d.pending.
-func (d *ExpandingDecoder) expandTemplate(t template, callsite Expanded) (*Expanded, error) {
+// expandTemplate starts the expansion of a template call, pushing a decoder
+// for the template body. The call stays on the call stack until its body
+// is exhausted.
+func (d *ExpandingDecoder) expandTemplate(t template, callsite Expanded) error {
 	// Set the stack before checking for recursion so error messages are correct.
 	callsite.Stack = d.callStack.framesCopy()
 
-	if !d.callStack.push(callsite) {
+	if !d.callStack.push(t.key(), callsite) {
 		var b strings.Builder
-		b.WriteString("recursion detected in template ")
-		b.WriteString(callsite.Name)
-		b.WriteString(":\n")
-		writeStack(&b, "    ", d.callStack.frames)
-		msg := strings.TrimSuffix(b.String(), "\n")
-		return nil, &ExpressionError{Expanded: callsite, Err: errors.New(msg)}
+		writeStack(&b, "    ", append(d.callStack.framesCopy(), callsite))
+		stack := strings.TrimSuffix(b.String(), "\n")
+		return &ExpressionError{
+			Expanded: callsite,
+			Err:      fmt.Errorf("%w in template %s:\n%s", ErrRecursion, callsite.Name, stack),
+		}
+	}
+	body, err := d.startBody(t, callsite)
+	if err != nil {
+		d.callStack.pop()
+		return err
+	}
+	d.decoderStack = append(d.decoderStack, decoderFrame{body: body})
+	return nil
+}
+
+// startBody checks and binds the arguments of a call to t, which is on top
+// of the call stack, and returns the expander for its body.
+func (d *ExpandingDecoder) startBody(t template, callsite Expanded) (*bodyExpander, error) {
+	if limit := d.limits.MaxCallDepth; limit > 0 && len(d.callStack.frames) > limit {
+		return nil, d.limitError(callsite, "MaxCallDepth", int64(limit), "template call depth exceeds limit of %d", limit)
+	}
+	if err := d.countCall(callsite); err != nil {
+		return nil, err
 	}
-	defer d.callStack.pop()
 
 	args := callArgs(callsite.Body, len(t.params))
 	if len(args) < t.required {
-		if t.required == len(t.params) {
-			return nil, &ExpressionError{
-				Expanded: callsite,
-				Err:      fmt.Errorf("template %q expects %d arguments, got %d", t.name, len(t.params), len(args)),
-			}
-		}
 		return nil, &ExpressionError{
 			Expanded: callsite,
-			Err:      fmt.Errorf("template %q expects at least %d arguments, got %d", t.name, t.required, len(args)),
+			Err: &ArityError{
+				Template: t.name,
+				Want:     t.required,
+				Got:      len(args),
+				AtLeast:  t.required < len(t.params),
+			},
+		}
+	}
+	args = t.bind(args)
+	d.callStack.frames[len(d.callStack.frames)-1].Args = args
+
+	b := &bodyExpander{t: t, call: callsite, args: args}
+	if t.fn != nil {
+		exprs, err := t.fn(callsite, args)
+		if err != nil {
+			return nil, &ExpressionError{Expanded: callsite, Err: err}
+		}
+		for _, expr := range exprs {
+			expr.Line = callsite.Line
+			b.out = append(b.out, Expanded{Expression: expr, File: callsite.File})
 		}
+		return b, nil
 	}
-	for len(args) < len(t.params) {
-		args = append(args, "")
+	if t.params.variadic() {
+		b.rest = args[len(t.params)-1:]
 	}
+	return b, nil
+}
 
-	lookup := func(name string) string {
-		if i := t.params.index(name); i >= 0 {
-			return args.At(i)
+// bind returns args with one element per parameter of t, using default
+// values for omitted optional arguments. The arguments of a variadic
+// parameter are split into one element each. The values are trimmed of
+// the trailing newline, as by [Args.At].
+func (t template) bind(args Args) Args {
+	for i := range args {
+		args[i] = args.At(i)
+	}
+	n := len(t.params)
+	if !t.params.variadic() {
+		for len(args) < n {
+			args = append(args, t.params[len(args)].defaultValue())
 		}
-		return ""
+		return args
 	}
+	var rest []string
+	if len(args) == n {
+		rest = strings.Fields(args[n-1])
+		args = args[:n-1]
+	}
+	for len(args) < n-1 {
+		args = append(args, t.params[len(args)].defaultValue())
+	}
+	return append(args, rest...)
+}
 
-	// Decode template body and substitute parameters.
-	dec := NewDecoder(strings.NewReader(t.body))
-	var expanded []Expanded
+// A bodyExpander produces the expressions of one template call, one at a
+// time, by substituting the arguments into the parsed template body.
+type bodyExpander struct {
+	t    template
+	call Expanded // the call, as it appears on the call stack
+	args Args     // as returned by bind
+	rest []string // variadic arguments
 
-	for {
-		rawExpr, err := dec.Decode()
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			var synErr *SyntaxError
-			if errors.As(err, &synErr) {
-				return nil, &ExpressionError{
-					Expanded: Expanded{Expression: Expression{Line: synErr.Line}, File: t.File},
-					Err:      errors.New(synErr.Message),
-				}
-			}
-			return nil, err
-		}
+	pos    int // index in t.exprs of the next expression
+	copies int // number of times t.exprs[pos-1] is repeated
+	i      int // number of copies of t.exprs[pos-1] produced so far
 
-		expr := Expanded{
-			Expression: rawExpr,
-			File:       t.File,
-		}
+	out []Expanded // remaining expressions of a DefineFunc template
+}
 
-		// Substitute parameters.
-		var unknown string
-		expr.Name, unknown = t.expand(expr.Name, lookup)
-		if unknown == "" {
-			expr.Body, unknown = t.expand(expr.Body, lookup)
-		}
-		if unknown != "" {
-			return nil, &ExpressionError{
-				Expanded: t.Expanded,
-				Err:      fmt.Errorf("unknown parameter reference: %q", unknown),
-			}
+// next returns the next expression of the body, or io.EOF.
+func (b *bodyExpander) next() (Expanded, error) {
+	if b.t.fn != nil {
+		if len(b.out) == 0 {
+			return Expanded{}, io.EOF
 		}
+		expr := b.out[0]
+		b.out = b.out[1:]
+		return expr, nil
+	}
 
-		if expr.Name == "define" {
-			return nil, &ExpressionError{
-				Expanded: callsite,
-				Err:      fmt.Errorf("expansion of %q contains illegal nested define: %q", t.name, expr.String()),
+	for b.i >= b.copies {
+		if b.pos == len(b.t.exprs) {
+			if b.t.bodyErr != nil {
+				return Expanded{}, b.t.bodyErr
 			}
+			return Expanded{}, io.EOF
 		}
+		b.pos++
 
-		// Recursively expand this expression.
-		result, err := d.expand(expr)
-		if err != nil {
-			return nil, err
-		}
-		if result != nil {
-			// Only set Stack if not already set by a nested expansion.
-			if len(result.Stack) == 0 {
-				result.Stack = d.callStack.framesCopy()
-			}
-			expanded = append(expanded, *result)
+		// Expressions referring to $name... repeat once per element.
+		b.i, b.copies = 0, 1
+		if b.t.exprs[b.pos-1].elements {
+			b.copies = len(b.rest)
 		}
-		// Collect any pending expressions from nested template expansion
-		// to maintain correct ordering.
-		expanded = append(expanded, d.pending...)
-		d.pending = nil
 	}
 
-	if len(expanded) == 0 {
-		return nil, nil
+	var elem string // the variadic argument for $name... references
+	if b.i < len(b.rest) {
+		elem = b.rest[b.i]
 	}
+	b.i++
+	return b.t.substitute(&b.t.exprs[b.pos-1], b.args, b.rest, elem)
+}
 
-	// Queue all but the first for later.
-	d.pending = append(d.pending, expanded[1:]...)
-	return &expanded[0], nil
+// substitute returns x with args, as returned by bind, substituted for
+// the parameters of t. References to the variadic parameter expand to rest,
+// and references to its elements expand to elem.
+func (t template) substitute(x *bodyExpr, args Args, rest []string, elem string) (Expanded, error) {
+	if x.unknown != "" {
+		return Expanded{}, &ExpressionError{
+			Expanded: t.Expanded,
+			Err:      &UnknownParameterError{Template: t.name, Name: x.unknown},
+		}
+	}
+	expr := Expanded{
+		Expression: x.Expression,
+		File:       t.File,
+	}
+	expr.Name = x.name.expand(args, rest, elem)
+	expr.Body = x.body.expand(args, rest, elem)
+	return expr, nil
 }
 
 func (d *ExpandingDecoder) define(expr Expanded) error {
@@ -349,26 +591,181 @@ func (d *ExpandingDecoder) define(expr Expanded) error {
 	if err != nil {
 		return err
 	}
-	if prev, ok := d.defs[t.name]; ok {
-		return fmt.Errorf("template %q redefined; previous define: %s:%d", t.name, prev.File, prev.Line)
+	t.file = d.scope()
+	return d.addTemplate(t)
+}
+
+func (d *ExpandingDecoder) addTemplate(t template) error {
+	if prev, ok := d.lookup(t.name, t.file); ok {
+		return &RedefinitionError{Template: t.name, Previous: prev.Expanded, Func: prev.fn != nil}
 	}
-	d.defs[t.name] = t
+	d.defs[t.key()] = t
 	return nil
 }
 
-func openRoot(fsys fs.FS, name string) (fs.File, error) {
+// scope returns the identity of the file whose private templates are
+// visible to the expression being expanded: the file that defines the
+// template whose body it is part of, or else the file it was read from.
+// The expressions returned by a DefineFunc template are in the scope of
+// its call.
+func (d *ExpandingDecoder) scope() string {
+	for i := len(d.decoderStack) - 1; i >= 0; i-- {
+		frame := d.decoderStack[i]
+		switch {
+		case frame.body == nil:
+			return frame.file
+		case frame.body.t.fn == nil:
+			return frame.body.t.file
+		}
+	}
+	return ""
+}
+
+// DefineFunc defines a template implemented in Go. The declaration is a
+// full parameter declaration, the template name and its parameters exactly
+// as they follow the define keyword in source, with optional and variadic
+// parameters and default values: "greet name title?=friend".
+//
+// A call to the template is checked and bound to its arguments the same way
+// as a call to a template defined in source, then fn is called with the call
+// expression and the arguments, one per parameter, with omitted optional
+// arguments as their default values. The expressions fn returns take the
+// file and line of the call, are expanded in turn, and carry the call in
+// their Stack. An error from fn is reported as an [ExpressionError] for
+// the call.
+//
+// DefineFunc returns an error if the declaration is invalid, names a
+// private template, or the template is already defined. A later define of
+// the same name in source is an error, as for any redefinition.
+func (d *ExpandingDecoder) DefineFunc(decl string, fn func(call Expanded, args Args) ([]Expression, error)) error {
+	t, err := makeTemplate(Expanded{Expression: Expression{Name: "define", Body: decl}})
+	if err != nil {
+		return err
+	}
+	if isPrivate(t.name) {
+		return fmt.Errorf("DefineFunc: template %q is private; only templates defined in a file can be private", t.name)
+	}
+	t.fn = fn
+	return d.addTemplate(t)
+}
+
+// openRoot opens the named file in fsys, or the .linebased file of the same
+// name if a .lb file does not exist. It returns the name of the file opened,
+// which is the identity of the file for include cycle detection.
+func openRoot(fsys fs.FS, name string) (fs.File, string, error) {
 	f, err := fsys.Open(name)
 	if err == nil {
-		return f, nil
+		return f, name, nil
 	}
 	stem, ok := strings.CutSuffix(name, ".lb")
 	if !ok {
-		return nil, err
+		return nil, "", err
 	}
 	if f, err2 := fsys.Open(stem + ".linebased"); err2 == nil {
-		return f, nil
+		return f, stem + ".linebased", nil
+	}
+	return nil, "", err
+}
+
+// popDecoder removes the current decoder from the stack. It closes the
+// decoder's file, or ends the template call whose body it expanded.
+func (d *ExpandingDecoder) popDecoder() {
+	frame := d.decoderStack[len(d.decoderStack)-1]
+	d.decoderStack = d.decoderStack[:len(d.decoderStack)-1]
+	if frame.body != nil {
+		d.callStack.pop()
+		return
+	}
+	if frame.f != nil {
+		frame.f.Close()
+	}
+	if frame.sum != nil {
+		file := setFile{sum: [sha256.Size]byte(frame.sum.Sum(nil)), size: -1}
+		if frame.info != nil {
+			file.size, file.modTime = frame.info.Size(), frame.info.ModTime()
+		}
+		d.set.files[d.includeStack[len(d.includeStack)-1]] = file
+	}
+	d.popInclude()
+}
+
+// fileFrame returns a frame decoding the named file from r, which is closed
+// by closing f. A decoder building a template set hashes each file as it
+// reads it, so that decoders using the set can check their includes.
+func (d *ExpandingDecoder) fileFrame(file string, r io.Reader, f io.Closer, include Expanded) decoderFrame {
+	frame := decoderFrame{file: file, f: f, include: include}
+	if d.building {
+		frame.sum = sha256.New()
+		frame.info = statFile(f)
+		r = io.TeeReader(r, frame.sum)
+	}
+	frame.dec = NewDecoder(r)
+	frame.dec.SetRecover(d.recovering)
+	return frame
+}
+
+// recovered reports whether the decoder recovers from err, recording it if
+// so. Errors that are reported more than once, such as a syntax error in a
+// template body reached by every call, are recorded once.
+func (d *ExpandingDecoder) recovered(err error) bool {
+	var exprErr *ExpressionError
+	var limitErr *LimitError
+	if !d.recovering || !errors.As(err, &exprErr) || errors.As(err, &limitErr) {
+		return false
+	}
+	msg := err.Error()
+	if !slices.ContainsFunc(d.errs, func(e error) bool { return e.Error() == msg }) {
+		d.errs = append(d.errs, err)
+	}
+	return true
+}
+
+// fail stops the decoder with err, returning the sticky error.
+func (d *ExpandingDecoder) fail(err error) error {
+	// Collect syntax errors skipped in files that were not read to the end.
+	for i := range d.decoderStack {
+		if frame := &d.decoderStack[i]; frame.dec != nil {
+			for _, err := range frame.dec.errs {
+				d.recovered(d.syntaxError(frame, err))
+			}
+		}
+	}
+	d.err = err
+	if len(d.errs) > 0 {
+		d.err = sortErrors(append(d.errs, err))
+	}
+	d.close()
+	return d.err
+}
+
+// sortErrors sorts list by the file and line of the expression in the
+// input that caused each error: the outermost template call for errors in
+// template expansions.
+func sortErrors(list ErrorList) ErrorList {
+	pos := func(err error) (string, int) {
+		var exprErr *ExpressionError
+		if !errors.As(err, &exprErr) {
+			return "", 0
+		}
+		site := exprErr.Expanded
+		if len(site.Stack) > 0 {
+			site = site.Stack[0]
+		}
+		return site.File, site.Line
+	}
+	slices.SortStableFunc(list, func(a, b error) int {
+		af, al := pos(a)
+		bf, bl := pos(b)
+		return cmp.Or(strings.Compare(af, bf), cmp.Compare(al, bl))
+	})
+	return list
+}
+
+// close releases any files still open on the decoder stack.
+func (d *ExpandingDecoder) close() {
+	for len(d.decoderStack) > 0 {
+		d.popDecoder()
 	}
-	return nil, err
 }
 
 func (d *ExpandingDecoder) pushInclude(name string) bool {
@@ -386,22 +783,66 @@ func (d *ExpandingDecoder) popInclude() {
 	d.includeStack = d.includeStack[:len(d.includeStack)-1]
 }
 
-func (d *ExpandingDecoder) includeCycle(next string) string {
-	var b strings.Builder
-	for _, name := range d.includeStack {
-		fmt.Fprintf(&b, "%s -> ", name)
-	}
-	b.WriteString(next)
-	return b.String()
-}
-
 type template struct {
 	Expanded
 
+	file     string // identity of the defining file; empty for DefineFunc templates
 	name     string
 	params   params
 	required int
 	body     string
+	fn       func(Expanded, Args) ([]Expression, error) // for DefineFunc templates
+
+	// exprs holds the expressions of body, parsed when the template is
+	// defined. If body has a syntax error, exprs holds the expressions
+	// before it and bodyErr reports it when a call reaches it.
+	exprs   []bodyExpr
+	bodyErr error
+}
+
+// key returns the key of t in the defs of a decoder.
+func (t template) key() defKey {
+	return makeKey(t.name, t.file)
+}
+
+// A defKey identifies a template. Private templates, whose names begin with
+// an underscore, are distinguished by their file as well as their name, so
+// that each file has its own.
+type defKey struct {
+	file string // identity of the defining file, for private templates only
+	name string
+}
+
+// makeKey returns the key of the template named name that is visible in
+// the file with identity file.
+func makeKey(name, file string) defKey {
+	if !isPrivate(name) {
+		file = ""
+	}
+	return defKey{file: file, name: name}
+}
+
+// privateFile returns the identity of a file that defines the private
+// template name, if any. If several do, it returns the first in sorted
+// order.
+func (d *ExpandingDecoder) privateFile(name string) (string, bool) {
+	var files []string
+	for _, defs := range []map[defKey]template{d.defs, d.setDefs()} {
+		for key := range defs {
+			if key.name == name && key.file != "" {
+				files = append(files, key.file)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return "", false
+	}
+	return slices.Min(files), true
+}
+
+// isPrivate reports whether name is the name of a private template.
+func isPrivate(name string) bool {
+	return strings.HasPrefix(name, "_")
 }
 
 func makeTemplate(decl Expanded) (template, error) {
@@ -431,9 +872,34 @@ func makeTemplate(decl Expanded) (template, error) {
 		required: required,
 		body:     body,
 	}
+	t.parseBody()
 	return t, nil
 }
 
+// parseBody parses the body of t into t.exprs, compiling the substitution
+// of parameters into each one.
+func (t *template) parseBody() {
+	dec := NewDecoder(strings.NewReader(t.body))
+	for {
+		rawExpr, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			var synErr *SyntaxError
+			if errors.As(err, &synErr) {
+				err = &ExpressionError{
+					Expanded: Expanded{Expression: Expression{Line: synErr.Line, Span: synErr.Span}, File: t.File},
+					Err:      errors.New(synErr.Message),
+				}
+			}
+			t.bodyErr = err
+			return
+		}
+		t.exprs = append(t.exprs, t.compile(rawExpr))
+	}
+}
+
 func callArgs(s string, n int) Args {
 	args := ParseArgs(s, n)
 	for len(args) > 0 && strings.TrimSpace(args[len(args)-1]) == "" {
@@ -442,10 +908,32 @@ func callArgs(s string, n int) Args {
 	return args
 }
 
+// A param is a parameter declaration: a name, optionally followed by "="
+// and a default value.
 type param string
 
+// name returns the name of p, as referred to in the template body.
+func (p param) name() string {
+	name, _, _ := strings.Cut(string(p), "=")
+	return name
+}
+
+// defaultValue returns the default value of p, or the empty string.
+func (p param) defaultValue() string {
+	_, v, _ := strings.Cut(string(p), "=")
+	return v
+}
+
+func (p param) hasDefault() bool {
+	return strings.Contains(string(p), "=")
+}
+
 func (p param) optional() bool {
-	return strings.HasSuffix(string(p), "?")
+	return strings.HasSuffix(p.name(), "?")
+}
+
+func (p param) variadic() bool {
+	return strings.HasSuffix(p.name(), "...")
 }
 
 type params []param
@@ -460,17 +948,39 @@ func parseParams(s string) params {
 }
 
 func (p params) index(name string) int {
-	return slices.Index(p, param(name))
+	return slices.IndexFunc(p, func(p param) bool { return p.name() == name })
 }
 
+// contains reports whether name refers to a parameter. The variadic
+// parameter "args..." is referred to as both "args" and "args...".
 func (p params) contains(name string) bool {
-	return p.index(name) >= 0
+	if p.index(name) >= 0 {
+		return true
+	}
+	return p.variadic() && name+"..." == p[len(p)-1].name()
+}
+
+// variadic reports whether the last parameter is variadic.
+func (p params) variadic() bool {
+	return len(p) > 0 && p[len(p)-1].variadic()
 }
 
 func (p params) required() (int, error) {
 	required := len(p)
 	var optional param
 	for i, param := range p {
+		if param.hasDefault() && !param.optional() {
+			return 0, fmt.Errorf("define: parameter %q has a default value but is not optional", param)
+		}
+		if param.variadic() {
+			if i != len(p)-1 {
+				return 0, fmt.Errorf("define: variadic parameter %q must be last", param)
+			}
+			if optional == "" {
+				required = i
+			}
+			continue
+		}
 		if param.optional() {
 			if optional == "" {
 				optional = param
@@ -485,22 +995,15 @@ func (p params) required() (int, error) {
 	return required, nil
 }
 
-func (t template) expand(s string, lookup func(string) string) (string, string) {
-	var unknown string
-	out := os.Expand(t.braceOptionalRefs(s), func(name string) string {
-		if !t.params.contains(name) && unknown == "" {
-			unknown = name
-		}
-		return lookup(name)
-	})
-	return out, unknown
-}
-
 func (t template) braceOptionalRefs(s string) string {
 	var b strings.Builder
 	var changed bool
 	start := 0
 	for i := 0; i+1 < len(s); i++ {
+		if s[i] == '$' && s[i+1] == '$' {
+			i++ // skip the escaped dollar sign
+			continue
+		}
 		if s[i] != '$' || s[i+1] == '{' || !isNameStart(s[i+1]) {
 			continue
 		}
@@ -508,11 +1011,16 @@ func (t template) braceOptionalRefs(s string) string {
 		for j < len(s) && isNameContinue(s[j]) {
 			j++
 		}
-		if j >= len(s) || s[j] != '?' {
+		var name string
+		switch {
+		case j < len(s) && s[j] == '?':
+			name = s[i+1 : j+1]
+		case strings.HasPrefix(s[j:], "..."):
+			name = s[i+1 : j+3]
+		default:
 			continue
 		}
-		name := s[i+1 : j+1]
-		if !t.params.contains(name) {
+		if t.params.index(name) < 0 {
 			continue
 		}
 		if !changed {
@@ -523,8 +1031,8 @@ func (t template) braceOptionalRefs(s string) string {
 		b.WriteString("${")
 		b.WriteString(name)
 		b.WriteByte('}')
-		i = j
-		start = j + 1
+		i = i + len(name)
+		start = i + 1
 	}
 	if !changed {
 		return s
@@ -544,17 +1052,24 @@ func isNameContinue(c byte) bool {
 // stack tracks template expansion call chains for debugging and error reporting.
 type stack struct {
 	frames []Expanded
-	seen   map[string]bool
+	keys   []defKey // templates called by frames
+	seen   map[defKey]bool
 }
 
-func (s *stack) push(expr Expanded) (initial bool) {
+// push pushes a call of the template with the given key, reporting whether
+// the template was not already being expanded. A recursive call is not
+// pushed, so the stack is unchanged for the expressions that follow it.
+func (s *stack) push(key defKey, expr Expanded) bool {
+	if s.seen[key] {
+		return false
+	}
 	if s.seen == nil {
-		s.seen = make(map[string]bool)
+		s.seen = make(map[defKey]bool)
 	}
 	s.frames = append(s.frames, expr)
-	initial = !s.seen[expr.Name]
-	s.seen[expr.Name] = true
-	return initial
+	s.keys = append(s.keys, key)
+	s.seen[key] = true
+	return true
 }
 
 func (s *stack) pop() Expanded {
@@ -562,8 +1077,10 @@ func (s *stack) pop() Expanded {
 		panic("pop called on empty stack")
 	}
 	expr := s.frames[len(s.frames)-1]
+	key := s.keys[len(s.keys)-1]
 	s.frames = s.frames[:len(s.frames)-1]
-	delete(s.seen, expr.Name)
+	s.keys = s.keys[:len(s.keys)-1]
+	delete(s.seen, key)
 	return expr
 }
 
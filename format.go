@@ -0,0 +1,153 @@
+package linebased
+
+import (
+	"strings"
+)
+
+// Format returns src in canonical linebased style:
+//
+//   - the name and tail of a command are separated by a single space
+//   - the header of a define is written with single spaces between fields,
+//     and its body is formatted recursively
+//   - runs of blank lines are collapsed to one, and blank lines at the start
+//     and end of the file are removed
+//   - indented comment lines that do not continue a command are moved to
+//     the start of the line, lining them up with their block
+//   - trailing whitespace is removed
+//   - continuation lines indented with a space rather than a tab are
+//     reindented with tabs, one tab per tab or run of up to four spaces
+//   - "\r\n" line endings are replaced by "\n"
+//
+// Continuation lines of commands other than define are otherwise left as
+// they are; whitespace after the leading tab is part of the body. Format
+// returns a [*SyntaxError] if src has an indented line that does not follow
+// a command and is not a comment.
+func Format(src []byte) ([]byte, error) {
+	text := strings.ReplaceAll(string(src), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil, nil
+	}
+	lines, err := formatLines(strings.Split(text, "\n"), 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// formatLines formats lines, the first of which is line number first of the
+// input. A continuation line that is empty after formatting is returned as
+// the empty string.
+func formatLines(lines []string, first int) ([]string, error) {
+	var out []string
+	blank := false // a blank line is pending
+	emit := func(line string) {
+		if blank && len(out) > 0 {
+			out = append(out, "")
+		}
+		blank = false
+		out = append(out, line)
+	}
+
+	for i := 0; i < len(lines); {
+		line := strings.TrimRight(lines[i], " \t\r")
+		switch {
+		case line == "":
+			blank = true
+			i++
+		case line[0] == '#':
+			emit(line)
+			i++
+		case line[0] == ' ' || line[0] == '\t':
+			text := strings.TrimLeft(line, " \t")
+			if text[0] != '#' {
+				return nil, &SyntaxError{
+					Line:    first + i,
+					Message: "unexpected whitespace at start of line",
+				}
+			}
+			emit(text)
+			i++
+		default:
+			name, tail := parseBody(line)
+			define := name == "define"
+			if define {
+				tail = strings.Join(strings.Fields(tail), " ")
+			}
+			switch {
+			case name == "" || name[0] == '#':
+				name = line // leading unusual whitespace; leave it be
+			case tail != "":
+				name += " " + tail
+			}
+			emit(name)
+
+			i++
+			start := i
+			var cont []string
+			for ; i < len(lines) && continues(lines[i:]); i++ {
+				cont = append(cont, reindent(lines[i]))
+			}
+			if define {
+				body, err := formatLines(cont, first+start)
+				if err != nil {
+					return nil, err
+				}
+				cont = body
+			}
+			for _, c := range cont {
+				out = append(out, "\t"+c)
+			}
+		}
+	}
+	return out, nil
+}
+
+// continues reports whether lines[0] is a continuation line. A line of only
+// whitespace continues a command if it starts with a tab or is followed by
+// an indented line with content.
+func continues(lines []string) bool {
+	line := lines[0]
+	if line == "" || (line[0] != ' ' && line[0] != '\t') {
+		return false
+	}
+	if strings.TrimLeft(line, " \t") != "" || line[0] == '\t' {
+		return true
+	}
+	for _, next := range lines[1:] {
+		if next == "" || (next[0] != ' ' && next[0] != '\t') {
+			return false
+		}
+		if strings.TrimLeft(next, " \t") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// reindent returns the content of continuation line without its leading
+// tab and trailing whitespace. If the line starts with a space instead of a
+// tab, its leading whitespace is replaced with tabs, counting each tab and
+// each run of up to four spaces as one level of indentation.
+func reindent(line string) string {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || line[0] == '\t' {
+		return line[min(1, len(line)):]
+	}
+	text := strings.TrimLeft(line, " \t")
+	indent := line[:len(line)-len(text)]
+	levels, spaces := 0, 0
+	for _, c := range indent {
+		if c == ' ' {
+			spaces++
+			continue
+		}
+		levels += (spaces+3)/4 + 1
+		spaces = 0
+	}
+	levels += (spaces + 3) / 4
+	return strings.Repeat("\t", levels-1) + text
+}
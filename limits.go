@@ -0,0 +1,148 @@
+package linebased
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Limits bounds the work an [ExpandingDecoder] does on behalf of a script.
+// They protect programs that expand untrusted scripts from templates that
+// expand exponentially and from very large or deeply nested includes.
+//
+// A zero field means no limit.
+type Limits struct {
+	// MaxCallDepth is the maximum number of nested template calls.
+	MaxCallDepth int
+
+	// MaxIncludeDepth is the maximum number of nested includes. The file
+	// the decoder was created with is not counted.
+	MaxIncludeDepth int
+
+	// MaxExpressions is the maximum number of expressions the decoder
+	// produces, counting blank lines and the expressions produced by
+	// template expansion. Defines and includes are not counted.
+	MaxExpressions int
+
+	// MaxExpressionBytes is the maximum length of the name and body of a
+	// single expression, before or after substitution.
+	MaxExpressionBytes int
+
+	// MaxIncludeBytes is the maximum size of an included file.
+	MaxIncludeBytes int64
+
+	// MaxCalls is the maximum number of template calls and includes the
+	// decoder performs, counting those that produce no expressions, such
+	// as a call of a template whose body is an include? of a missing file.
+	MaxCalls int
+}
+
+// SetLimits sets the limits on expansion. Breaching a limit is reported as
+// an [ExpressionError] whose message includes the template call stack, and
+// stops the decoder.
+//
+// SetLimits must be called before the first call to Decode.
+func (d *ExpandingDecoder) SetLimits(l Limits) {
+	d.limits = l
+}
+
+// checkSize reports an error if expr exceeds MaxExpressionBytes.
+func (d *ExpandingDecoder) checkSize(expr Expanded) error {
+	limit := d.limits.MaxExpressionBytes
+	if limit > 0 && len(expr.Name)+len(expr.Body) > limit {
+		return d.limitError(expr, "MaxExpressionBytes", int64(limit), "expression exceeds limit of %d bytes", limit)
+	}
+	return nil
+}
+
+// count counts expr as produced, reporting an error if it exceeds
+// MaxExpressions.
+func (d *ExpandingDecoder) count(expr Expanded) error {
+	d.produced++
+	limit := d.limits.MaxExpressions
+	if limit > 0 && d.produced > limit {
+		return d.limitError(expr, "MaxExpressions", int64(limit), "expansion exceeds limit of %d expressions", limit)
+	}
+	return nil
+}
+
+// countCall counts a template call or include by expr, reporting an error
+// if it exceeds MaxCalls.
+func (d *ExpandingDecoder) countCall(expr Expanded) error {
+	d.calls++
+	limit := d.limits.MaxCalls
+	if limit > 0 && d.calls > limit {
+		return d.limitError(expr, "MaxCalls", int64(limit), "expansion exceeds limit of %d template calls and includes", limit)
+	}
+	return nil
+}
+
+// limitError returns an ExpressionError for expr with a LimitError for the
+// named limit, whose message is followed by the current call stack.
+func (d *ExpandingDecoder) limitError(expr Expanded, limit string, value int64, format string, args ...any) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, format, args...)
+	if len(d.callStack.frames) > 0 {
+		b.WriteString(":\n")
+		writeStack(&b, "    ", d.callStack.frames)
+	}
+	if len(expr.Stack) == 0 {
+		expr.Stack = d.callStack.framesCopy()
+	}
+	return &ExpressionError{
+		Expanded: expr,
+		Err: &LimitError{
+			Limit: limit,
+			Value: value,
+			msg:   strings.TrimSuffix(b.String(), "\n"),
+		},
+	}
+}
+
+// checkInclude reports an error if the include of file by expr exceeds
+// MaxIncludeDepth or, when file has a Stat method reporting its size,
+// MaxIncludeBytes.
+func (d *ExpandingDecoder) checkInclude(expr Expanded, file io.Reader) error {
+	if limit := d.limits.MaxIncludeDepth; limit > 0 && len(d.includeStack)-1 > limit {
+		return d.limitError(expr, "MaxIncludeDepth", int64(limit), "include depth exceeds limit of %d", limit)
+	}
+	stat, ok := file.(interface{ Stat() (fs.FileInfo, error) })
+	if limit := d.limits.MaxIncludeBytes; limit > 0 && ok {
+		if info, err := stat.Stat(); err == nil && info.Mode().IsRegular() && info.Size() > limit {
+			return d.includeSizeError(expr, limit)
+		}
+	}
+	return nil
+}
+
+func (d *ExpandingDecoder) includeSizeError(expr Expanded, limit int64) error {
+	name := ParseArgs(expr.Body, 1).At(0)
+	return d.limitError(expr, "MaxIncludeBytes", limit, "include: file %q exceeds limit of %d bytes", name, limit)
+}
+
+// errIncludeTooLarge is returned by a limitReader that reaches its limit.
+var errIncludeTooLarge = errors.New("include too large")
+
+// limitReader reads from r, failing once more than n bytes have been read.
+// It guards includes whose size is not known in advance.
+type limitReader struct {
+	r io.Reader
+	n int64 // bytes remaining
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errIncludeTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return 0, errIncludeTooLarge
+	}
+	return n, err
+}
@@ -77,6 +77,16 @@
 //	define shout word
 //		echo ${word}!!!
 //
+// Every other $ in a template body must begin a parameter reference. Write $$
+// for a literal dollar sign:
+//
+//	define run cmd
+//		sh -c '$cmd > $$HOME/log'
+//	run date              # sh -c 'date > $HOME/log'
+//
+// Expressions outside of template bodies are not substituted, so $$ has no
+// special meaning there.
+//
 // Parameters ending in "?" are optional. The "?" is part of the parameter name,
 // so template bodies refer to $suffix? or ${suffix?}. Missing optional
 // arguments expand to empty strings:
@@ -86,12 +96,35 @@
 //	greet Alice          # echo Hello, Alice
 //	greet Alice !        # echo Hello, Alice!
 //
+// An optional parameter can declare a default value after "=". The default
+// is used when the argument is missing and is referred to by the parameter
+// name alone:
+//
+//	define greet name title?=friend
+//		echo Hello, $title? $name
+//	greet Alice          # echo Hello, friend Alice
+//	greet Alice Dr.      # echo Hello, Dr. Alice
+//
+// Only optional parameters can have defaults.
+//
 // Optional parameters must form a suffix of the parameter list. A required
 // parameter cannot follow an optional one:
 //
 //	define bad first? last
 //		echo $first? $last
 //
+// A final parameter ending in "..." is variadic. It binds the remaining
+// whitespace-separated arguments, zero or more, as a list. In the body,
+// $hosts or ${hosts} expands to the list joined by single spaces, and
+// $hosts... or ${hosts...} repeats the expression once per element:
+//
+//	define deploy app hosts...
+//		echo deploying $app to $hosts
+//		ssh $hosts... restart $app
+//	deploy web a b        # echo deploying web to a b
+//	                      # ssh a restart web
+//	                      # ssh b restart web
+//
 // Templates can invoke other templates:
 //
 //	define inner x
@@ -100,6 +133,21 @@
 //		inner $y
 //	outer hello           # echo hello
 //
+// Templates whose names begin with an underscore are private to the file
+// that defines them. They can be called in that file and in the bodies of
+// the templates it defines, wherever those are called. Other files may
+// define private templates of the same name without conflict; calling one
+// from a file that does not define it is an error. Libraries use them for
+// helpers:
+//
+//	# lib/http.linebased
+//	define _curl method url
+//		curl -X $method $url
+//	define get url
+//		_curl GET $url
+//
+// A script that includes lib/http can call get, but not _curl.
+//
 // Constraints:
 //   - Recursion is forbidden.
 //   - Templates cannot be redefined.
@@ -112,13 +160,42 @@
 //	include helpers
 //	include common
 //
-// Include paths must be simple filenames without directory separators.
 // The ".linebased" extension is added automatically, so "include helpers"
 // opens "helpers.linebased" from the [fs.FS] passed to [NewExpandingDecoder].
+// Include paths are slash-separated and always relative to the root of that
+// file system, never to the including file: "include lib/http" opens
+// "lib/http.linebased" wherever the include appears. Paths containing "."
+// or ".." elements, such as "../secrets", are rejected, so a script cannot
+// reach outside the root.
+//
+// [ExpandingDecoder.SetIncludePath] adds more file systems to search, in
+// order, for files the first does not have, such as a vendor directory and
+// a standard library of templates. For includes served from elsewhere, such
+// as the unsaved buffers of an editor, set a [Resolver] with
+// [ExpandingDecoder.SetResolver]. The resolver gives each file a canonical
+// identity, which names the file in error messages and detects include
+// cycles.
 //
 // Included files can define templates used by the including file. Include cycles
 // are detected and reported as errors.
 //
+// The "include?" builtin is an optional include. It does nothing if the file
+// does not exist, but otherwise reads it exactly as include does, reporting
+// any errors in it. It suits machine-local overrides that are not checked
+// in:
+//
+//	include defaults
+//	include? local
+//
+// # Limits
+//
+// A short script can still ask for a great deal of work: a template that
+// calls another ten times, which calls another ten times, and so on, expands
+// exponentially, even if the templates at the bottom produce nothing.
+// Programs that expand untrusted scripts should bound the number of template
+// calls and includes, call depth, include depth and size, and the number
+// and size of expressions with [ExpandingDecoder.SetLimits].
+//
 // # Blank Lines
 //
 // Blank lines produce expressions with empty names. This preserves the visual
@@ -151,6 +228,16 @@
 //		}
 //		// process expr
 //	}
+//
+// The Err of an ExpressionError classifies common failures. Use [errors.Is]
+// with [ErrRecursion] and [ErrNestedDefine], and [errors.As] with
+// [*ArityError], [*UnknownParameterError], [*IncludeCycleError],
+// [*RedefinitionError], and [*LimitError]:
+//
+//	var arity *linebased.ArityError
+//	if errors.As(err, &arity) {
+//		fmt.Printf("%s needs %d arguments\n", arity.Template, arity.Want)
+//	}
 package linebased
 
 import (
@@ -163,7 +250,7 @@ import (
 // Expanded represents a parsed expression from the input stream, capturing
 // both its content and context within the template expansion process.
 //
-// Expressions are intended to be produced by [Expressions] or [Expand], not built manually.
+// Expanded values are intended to be produced by [Expand] or [ExpandingDecoder], not built manually.
 type Expanded struct {
 	Expression
 
@@ -173,6 +260,12 @@ type Expanded struct {
 	// Stack contains the call stack of the template expansions that
 	// produced this expression.
 	Stack []Expanded
+
+	// Args holds the arguments bound to the template's parameters when
+	// this expression is a frame in a Stack, with omitted optional
+	// arguments as their default values and without the trailing newline
+	// of the last argument. It is nil otherwise.
+	Args Args
 }
 
 // String formats the expression as parseable source text.
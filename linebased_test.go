@@ -1,6 +1,7 @@
 package linebased
 
 import (
+	"bytes"
 	"embed"
 	"errors"
 	"flag"
@@ -8,12 +9,14 @@ import (
 	"io"
 	"io/fs"
 	"maps"
+	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
 	"testing"
 	"testing/fstest"
+	"time"
 	"unicode"
 
 	"kr.dev/diff"
@@ -45,6 +48,235 @@ func FuzzExpressions(f *testing.F) {
 	})
 }
 
+func FuzzEncoder(f *testing.F) {
+	f.Add("foo bar baz\n")
+	f.Add("# comment\ncmd\n\tcontinued\n\t# not a comment\n\t\n")
+	f.Add("cmd\n\n# trailing comment")
+	f.Add("a\r\n\tb\r\n")
+	f.Add("0 0")
+	f.Add("\r#\n0\r00\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		dec := NewDecoder(strings.NewReader(input))
+		for {
+			want, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			// Encode always terminates expressions.
+			if !strings.HasSuffix(want.Body, "\n") {
+				want.Body += "\n"
+			}
+			if want.Comment != "" && !strings.HasSuffix(want.Comment, "\n") {
+				want.Comment += "\n"
+			}
+
+			var b strings.Builder
+			if err := NewEncoder(&b).Encode(want); err != nil {
+				if want.Name == "" || want.NameSpan.Start.Column != 1 {
+					// Lines starting with other whitespace, such as
+					// "\r\n" or "\r#", decode to names that
+					// cannot be written back at the start of a line.
+					continue
+				}
+				t.Fatalf("Encode(%+v): %v", want, err)
+			}
+			got, err := NewDecoder(strings.NewReader(b.String())).Decode()
+			if err != nil {
+				t.Fatalf("Decode(%q): %v", b.String(), err)
+			}
+			if got.Comment != want.Comment || got.Name != want.Name || got.Body != want.Body {
+				t.Fatalf("round trip of %q:\n got %q %q %q\nwant %q %q %q",
+					b.String(), got.Comment, got.Name, got.Body, want.Comment, want.Name, want.Body)
+			}
+		}
+	})
+}
+
+func TestEncoder(t *testing.T) {
+	tests := []struct {
+		expr    Expression
+		want    string
+		wantErr string
+	}{
+		{Expression{Name: "echo", Body: "hello world\n"}, "echo hello world\n", ""},
+		{Expression{Name: "echo", Body: "hello"}, "echo hello\n", ""},
+		{Expression{Name: "echo", Body: ""}, "echo\n", ""},
+		{Expression{Name: "echo", Body: "\n"}, "echo\n", ""},
+		{Expression{Name: "sql", Body: "\nSELECT 1\nFROM t\n"}, "sql\n\tSELECT 1\n\tFROM t\n", ""},
+		{Expression{Name: "sql", Body: "query\nSELECT 1\n"}, "sql query\n\tSELECT 1\n", ""},
+		{Expression{Name: "note", Body: "\n# not a comment\n\nafter blank\n"}, "note\n\t# not a comment\n\t\n\tafter blank\n", ""},
+		{Expression{Name: "echo", Body: "# inline\n"}, "echo # inline\n", ""},
+		{Expression{Comment: "# one\n# two", Name: "echo", Body: "hi\n"}, "# one\n# two\necho hi\n", ""},
+		{Expression{Comment: "# heading\n", Body: "\n"}, "# heading\n\n", ""},
+		{Expression{}, "\n", ""},
+
+		{Expression{Name: "two words", Body: "\n"}, "", `encode: name "two words" contains whitespace`},
+		{Expression{Name: "#echo", Body: "\n"}, "", `encode: name "#echo" starts with '#'`},
+		{Expression{Name: "echo", Body: " indented\n"}, "", `encode: body of "echo" begins with whitespace`},
+		{Expression{Name: "echo", Body: "\tindented\n"}, "", `encode: body of "echo" begins with whitespace`},
+		{Expression{Comment: "not a comment\n", Name: "echo"}, "", `encode: comment line "not a comment" does not start with '#'`},
+		{Expression{Body: "orphan\n"}, "", "encode: expression without a name has a body"},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		err := NewEncoder(&b).Encode(tt.expr)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Encode(%+v) error = %v, want %q", tt.expr, err, tt.wantErr)
+			}
+			if b.Len() > 0 {
+				t.Errorf("Encode(%+v) wrote %q on error", tt.expr, b.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Encode(%+v): %v", tt.expr, err)
+			continue
+		}
+		if b.String() != tt.want {
+			t.Errorf("Encode(%+v) = %q, want %q", tt.expr, b.String(), tt.want)
+		}
+
+		got, err := NewDecoder(strings.NewReader(b.String())).Decode()
+		if err != nil {
+			t.Errorf("Decode(%q): %v", b.String(), err)
+			continue
+		}
+		wantComment := tt.expr.Comment
+		if wantComment != "" && !strings.HasSuffix(wantComment, "\n") {
+			wantComment += "\n"
+		}
+		wantBody := tt.expr.Body
+		if !strings.HasSuffix(wantBody, "\n") {
+			wantBody += "\n"
+		}
+		if got.Comment != wantComment || got.Name != tt.expr.Name || got.Body != wantBody {
+			t.Errorf("round trip of %q = %q %q %q", b.String(), got.Comment, got.Name, got.Body)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  string
+	}{
+		{"", "", ""},
+		{"\n\n", "", ""},
+		{"echo   hello  world\n", "echo hello  world\n", ""},
+		{"echo\thello\n", "echo hello\n", ""},
+		{"echo hi   \t\n", "echo hi\n", ""},
+		{"echo hi", "echo hi\n", ""},
+		{"a\r\nb\r\n", "a\nb\n", ""},
+		{"\n\na\n\n\n\nb\n\n\n", "a\n\nb\n", ""},
+		{"  # one\n\t# two\n# three\ncmd\n", "# one\n# two\n# three\ncmd\n", ""},
+		{"sql\n    SELECT 1\n      FROM t\n", "sql\n\tSELECT 1\n\t\tFROM t\n", ""},
+		{"sql\n\tSELECT 1\n\t    FROM t  \n", "sql\n\tSELECT 1\n\t    FROM t\n", ""},
+		{"yaml config\n\ta:\n\t  b: 1\n", "yaml config\n\ta:\n\t  b: 1\n", ""},
+		{"note\n\tone\n\t  \n\ttwo\n", "note\n\tone\n\t\n\ttwo\n", ""},
+		{"note\n\tone\n  \n\ttwo\n", "note\n\tone\n\t\n\ttwo\n", ""},
+		{"note\n\tone\n  \n\nnext\n", "note\n\tone\n\nnext\n", ""},
+		{
+			"define  greet   name\n    echo   hello, $name\n    \n    \n    echo   bye\n",
+			"define greet name\n\techo hello, $name\n\t\n\techo bye\n",
+			"",
+		},
+		{
+			"define outer\n\tdefine inner x\n\t\techo  $x\n\tinner  1\n",
+			"define outer\n\tdefine inner x\n\t\techo $x\n\tinner 1\n",
+			"",
+		},
+		{"a\n\n  orphan\n", "", "3: unexpected whitespace at start of line"},
+		{"define d\n\t\techo\n", "", "2: unexpected whitespace at start of line"},
+	}
+	for _, tt := range tests {
+		got, err := Format([]byte(tt.in))
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Format(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Format(%q): %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("Format(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzFormat(f *testing.F) {
+	f.Add("echo   hello\n\n\n# c\n  # d\ncmd\n    cont\n")
+	f.Add("define  t  a b?\n    echo $a\n\n\n\t\tx\n")
+	f.Add("a\r\n\t\r\n\tb\r\n")
+	f.Add("yaml config\n\ta:\n\t  b: 1\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		got, err := Format([]byte(input))
+		if err != nil {
+			return
+		}
+		if want, err := decodeFormatted(input); err == nil {
+			have, err := decodeFormatted(string(got))
+			if err != nil {
+				t.Fatalf("decoding Format(%q) = %q: %v", input, got, err)
+			}
+			if !slices.Equal(have, want) {
+				t.Fatalf("Format changed the expressions of %q:\n got %q\nwant %q", input, have, want)
+			}
+		}
+		again, err := Format(got)
+		if err != nil {
+			t.Fatalf("Format(Format(%q)): %v", input, err)
+		}
+		if !bytes.Equal(got, again) {
+			t.Fatalf("Format is not idempotent for %q:\n got %q\nthen %q", input, got, again)
+		}
+	})
+}
+
+// decodeFormatted decodes src into the expressions Format must preserve,
+// one string per command. Blank lines, trailing whitespace and trailing blank
+// continuation lines are dropped, and define headers and bodies are
+// compared as Format writes them.
+func decodeFormatted(src string) ([]string, error) {
+	var out []string
+	d := NewDecoder(strings.NewReader(src))
+	for {
+		expr, err := d.Decode()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if expr.Name == "" {
+			continue
+		}
+		lines := strings.Split(expr.Body, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, " \t\r")
+		}
+		for len(lines) > 1 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if expr.Name != "define" {
+			out = append(out, expr.Name+" "+strings.Join(lines, "\n"))
+			continue
+		}
+		body, err := decodeFormatted(strings.Join(lines[1:], "\n"))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, "define "+strings.Join(strings.Fields(lines[0]), " "))
+		for _, s := range body {
+			out = append(out, "\t"+s)
+		}
+	}
+}
+
 func TestCutField(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -292,6 +524,127 @@ func TestExpressionsCommentCapture(t *testing.T) {
 	}
 }
 
+func TestDecoderSpans(t *testing.T) {
+	const input = "" +
+		"# one\n" + // 0
+		"# two\n" + // 6
+		"cmd   inline tail\n" + // 12
+		"\tfirst\n" + // 30
+		"\t\n" + // 37
+		"\n" + // 39
+		"bare\r\n" // 40
+
+	// span formats a span as line:col-line:col@offset-offset.
+	span := func(s Span) string {
+		return fmt.Sprintf("%d:%d-%d:%d@%d-%d", s.Start.Line, s.Start.Column, s.End.Line, s.End.Column, s.Start.Offset, s.End.Offset)
+	}
+
+	var got []string
+	dec := NewDecoder(strings.NewReader(input))
+	for {
+		expr, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%q span=%s name=%s tail=%s comment=%s", expr.Name,
+			span(expr.Span), span(expr.NameSpan), span(expr.TailSpan), span(expr.CommentSpan)))
+		for _, s := range expr.ContinuationSpans {
+			got = append(got, "  cont="+span(s))
+		}
+	}
+
+	want := []string{
+		`"cmd" span=3:1-5:2@12-38 name=3:1-3:4@12-15 tail=3:7-3:18@18-29 comment=1:1-2:6@0-11`,
+		`  cont=4:2-4:7@31-36`,
+		`  cont=5:2-5:2@38-38`,
+		`"" span=6:1-6:1@39-39 name=6:1-6:1@39-39 tail=6:1-6:1@39-39 comment=0:0-0:0@0-0`,
+		`"bare" span=7:1-7:5@40-44 name=7:1-7:5@40-44 tail=7:5-7:5@44-44 comment=0:0-0:0@0-0`,
+	}
+	diff.Test(t, t.Errorf, got, want)
+}
+
+func TestDecoderRecover(t *testing.T) {
+	const input = "" +
+		"one\n" +
+		" bad\n" +
+		"\tskipped continuation\n" +
+		"two\n" +
+		"\tcontinued\n" +
+		"\n" +
+		"# orphan\n" +
+		"\tbad\n" +
+		"three\n"
+
+	dec := NewDecoder(strings.NewReader(input))
+	dec.SetRecover(true)
+
+	var got []string
+	var gotErr error
+	for {
+		expr, err := dec.Decode()
+		if err != nil {
+			gotErr = err
+			break
+		}
+		got = append(got, fmt.Sprintf("%d %q %q", expr.Line, expr.Name, expr.Comment))
+	}
+
+	want := []string{
+		`1 "one" ""`,
+		`4 "two" ""`,
+		`6 "" ""`,
+		`9 "three" ""`,
+	}
+	diff.Test(t, t.Errorf, got, want)
+
+	var errs ErrorList
+	if !errors.As(gotErr, &errs) {
+		t.Fatalf("error = %v, want ErrorList", gotErr)
+	}
+	var lines []int
+	for _, err := range errs {
+		var synErr *SyntaxError
+		if !errors.As(err, &synErr) {
+			t.Fatalf("error %v is not a SyntaxError", err)
+		}
+		lines = append(lines, synErr.Line)
+	}
+	if !slices.Equal(lines, []int{2, 8}) {
+		t.Errorf("error lines = %v, want [2 8]", lines)
+	}
+	var synErr *SyntaxError
+	if !errors.As(gotErr, &synErr) || synErr.Line != 2 {
+		t.Errorf("errors.As(list) = %v, want first syntax error", synErr)
+	}
+	if want := "2: unexpected whitespace at start of line\n8: unexpected whitespace at start of line"; gotErr.Error() != want {
+		t.Errorf("Error() = %q, want %q", gotErr.Error(), want)
+	}
+
+	// The list is returned in place of io.EOF on every later call.
+	if _, err := dec.Decode(); !errors.As(err, &errs) {
+		t.Errorf("second Decode at EOF = %v, want ErrorList", err)
+	}
+}
+
+func TestSyntaxErrorSpan(t *testing.T) {
+	fsys := fstest.MapFS{"main.lb": &fstest.MapFile{Data: []byte("ok\n  bad line\n")}}
+	var gotErr error
+	for _, err := range Expand("main.lb", fsys) {
+		gotErr = err
+	}
+	var exprErr *ExpressionError
+	if !errors.As(gotErr, &exprErr) {
+		t.Fatalf("error = %v, want ExpressionError", gotErr)
+	}
+	want := Span{Pos{3, 2, 1}, Pos{13, 2, 11}}
+	if exprErr.Span != want {
+		t.Errorf("span = %+v, want %+v", exprErr.Span, want)
+	}
+}
+
 func Example_expansion() {
 	const script = "" +
 		"define echo tail\n" +
@@ -366,141 +719,1164 @@ func Example_include() {
 	// say Goodbye, Bob!
 }
 
-func TestExpandInclude(t *testing.T) {
-	t.Run("ok", func(t *testing.T) {
-		fsys := fstest.MapFS{
-			"main.linebased":  &fstest.MapFile{Data: []byte("include other\n")},
-			"other.linebased": &fstest.MapFile{Data: []byte("define echo tail\necho hi\n")},
-		}
+func ExampleExpandingDecoder_DefineFunc() {
+	const script = "" +
+		"define greet name\n" +
+		"\tshout Hello, $name\n" +
+		"greet Alice\n"
 
-		var got []string
-		d := NewExpandingDecoder("main.linebased", fsys)
-		for {
-			expr, err := d.Decode()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				t.Fatalf("Expanded error: %v", err)
-			}
-			if expr.Name == "" {
-				continue
-			}
-			got = append(got, expr.String())
+	fsys := fstest.MapFS{"example.lb": &fstest.MapFile{Data: []byte(script)}}
+	d := NewExpandingDecoder("example.lb", fsys)
+	err := d.DefineFunc("shout text", func(call Expanded, args Args) ([]Expression, error) {
+		text := strings.ToUpper(strings.TrimSpace(args.At(0)))
+		return []Expression{{Name: "echo", Body: text + "!\n"}}, nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for {
+		expr, err := d.Decode()
+		if err == io.EOF {
+			break
 		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%s", expr.String())
+	}
 
-		want := []string{"echo hi\n"}
-		if !slices.Equal(got, want) {
-			t.Fatalf("include output: got %v, want %v", got, want)
+	// Output:
+	// echo HELLO, ALICE!
+}
+
+func ExampleExpressions() {
+	const script = "" +
+		"# Say hello.\n" +
+		"echo hello\n" +
+		"sql query\n" +
+		"\tSELECT 1\n"
+
+	for expr, err := range Expressions(strings.NewReader(script)) {
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
-	})
+		fmt.Printf("%d %s %q\n", expr.Line, expr.Name, expr.Body)
+	}
 
-	t.Run("missing", func(t *testing.T) {
-		fsys := fstest.MapFS{
-			"main.lb": &fstest.MapFile{Data: []byte("include missing\n")},
+	// Output:
+	// 2 echo "hello\n"
+	// 3 sql "query\nSELECT 1\n"
+}
+
+func ExampleExpand() {
+	fsys := fstest.MapFS{
+		"main.lb": &fstest.MapFile{Data: []byte("" +
+			"define greet name\n" +
+			"\techo Hello, $name!\n" +
+			"greet Alice\n",
+		)},
+	}
+
+	for expr, err := range Expand("main.lb", fsys) {
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
-		var gotErr error
-		d := NewExpandingDecoder("main.lb", fsys)
-		for {
-			_, err := d.Decode()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				gotErr = err
-				break
-			}
+		fmt.Print(expr.String())
+	}
+
+	// Output:
+	// echo Hello, Alice!
+}
+
+func TestExpressionsStopsAtError(t *testing.T) {
+	var got []string
+	var gotErr error
+	for expr, err := range Expressions(strings.NewReader("one\n two\nthree\n")) {
+		if err != nil {
+			gotErr = err
+			continue
 		}
+		got = append(got, expr.Name)
+	}
+	if !slices.Equal(got, []string{"one"}) {
+		t.Errorf("expressions = %v, want [one]", got)
+	}
+	var synErr *SyntaxError
+	if !errors.As(gotErr, &synErr) || synErr.Line != 2 {
+		t.Errorf("error = %v, want syntax error on line 2", gotErr)
+	}
+}
 
-		if gotErr == nil {
-			t.Fatalf("expected error for missing include, got nil")
+func TestStackArgs(t *testing.T) {
+	fsys := fstest.MapFS{"main.linebased": &fstest.MapFile{Data: []byte(
+		"define greet name title?\n\techo hi $title? $name\ndefine outer x\n\tgreet $x\nouter bob\n",
+	)}}
+	var got []Args
+	for expr, err := range Expand("main.linebased", fsys) {
+		if err != nil {
+			t.Fatal(err)
 		}
-		var pe *fs.PathError
-		if !errors.As(gotErr, &pe) {
-			t.Fatalf("expected PathError, got %T: %v", gotErr, gotErr)
+		for _, frame := range expr.Stack {
+			got = append(got, frame.Args)
 		}
-		if pe.Path != "missing.linebased" {
-			t.Fatalf("unexpected PathError path: %q", pe.Path)
+		if expr.Args != nil {
+			t.Errorf("expression %q has Args %q; want nil", expr.Name, expr.Args)
 		}
-	})
+	}
+	want := []Args{{"bob"}, {"bob", ""}}
+	diff.Test(t, t.Errorf, got, want)
+}
 
-	t.Run("cycle", func(t *testing.T) {
-		fsys := fstest.MapFS{
-			"main.linebased": &fstest.MapFile{Data: []byte("include a\n")},
-			"a.linebased":    &fstest.MapFile{Data: []byte("include b\n")},
-			"b.linebased":    &fstest.MapFile{Data: []byte("include a\n")},
+func TestDefineFunc(t *testing.T) {
+	calls := 0
+	newDecoder := func(script string) *ExpandingDecoder {
+		fsys := fstest.MapFS{"main.linebased": &fstest.MapFile{Data: []byte(script)}}
+		d := NewExpandingDecoder("main.linebased", fsys)
+		must := func(err error) {
+			t.Helper()
+			if err != nil {
+				t.Fatal(err)
+			}
 		}
-		var gotErr error
-		d := NewExpandingDecoder("main.lb", fsys)
+		must(d.DefineFunc("now", func(call Expanded, args Args) ([]Expression, error) {
+			calls++
+			return []Expression{{Name: "time", Body: "2024-01-02\n"}}, nil
+		}))
+		must(d.DefineFunc("wrap name rest?", func(call Expanded, args Args) ([]Expression, error) {
+			return []Expression{
+				{Name: "begin", Body: args.At(0) + "\n"},
+				{Name: "greet", Body: args.At(1)},
+				{Name: "end", Body: args.At(0) + "\n"},
+			}, nil
+		}))
+		must(d.DefineFunc("fail", func(call Expanded, args Args) ([]Expression, error) {
+			return nil, errors.New("boom")
+		}))
+		must(d.DefineFunc("loop", func(call Expanded, args Args) ([]Expression, error) {
+			return []Expression{{Name: "loop", Body: "\n"}}, nil
+		}))
+		must(d.DefineFunc("sneaky", func(call Expanded, args Args) ([]Expression, error) {
+			return []Expression{{Name: "define", Body: "x\n"}}, nil
+		}))
+		return d
+	}
+	decodeAll := func(d *ExpandingDecoder) ([]Expanded, error) {
+		var got []Expanded
 		for {
-			_, err := d.Decode()
+			expr, err := d.Decode()
 			if err == io.EOF {
-				break
+				return got, nil
 			}
 			if err != nil {
-				gotErr = err
-				break
+				return got, err
 			}
+			got = append(got, expr)
 		}
+	}
 
-		if gotErr == nil {
-			t.Fatalf("expected cycle error, got nil")
+	t.Run("expand", func(t *testing.T) {
+		d := newDecoder("define greet who\n\techo hi $who\nnow\nwrap outer Bob\n")
+		got, err := decodeAll(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for _, expr := range got {
+			var stack []string
+			for _, frame := range expr.Stack {
+				stack = append(stack, frame.Name)
+			}
+			lines = append(lines, expr.Where()+" "+strings.TrimSuffix(expr.String(), "\n")+" "+strings.Join(stack, ">"))
+		}
+		want := []string{
+			"main.linebased:3: now@3 time 2024-01-02 now",
+			"main.linebased:4: wrap@4 begin outer wrap",
+			"main.linebased:4: greet@1 echo hi Bob wrap>greet",
+			"main.linebased:4: wrap@4 end outer wrap",
+		}
+		diff.Test(t, t.Errorf, lines, want)
+		if calls != 1 {
+			t.Errorf("now called %d times, want 1", calls)
+		}
+	})
+
+	errorTests := []struct {
+		script string
+		want   string
+	}{
+		{"wrap\n", `main.linebased:1: template "wrap" expects at least 1 arguments, got 0`},
+		{"now\nfail\n", "main.linebased:2: boom"},
+		{"now\nloop\n", "main.linebased:2: loop@2: recursion detected in template loop:\n    main.linebased:2: main@2> loop\n    main.linebased:2: loop@2> loop"},
+		{"sneaky\n", `main.linebased:1: expansion of "sneaky" contains illegal nested define: "define x\n"`},
+		{"define now\n\techo\n", `main.linebased:1: template "now" redefined; previously defined by DefineFunc`},
+	}
+	for _, tt := range errorTests {
+		_, err := decodeAll(newDecoder(tt.script))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("script %q: error = %v, want %q", tt.script, err, tt.want)
+		}
+	}
+
+	d := newDecoder("")
+	if err := d.DefineFunc("now", nil); err == nil || err.Error() != `template "now" redefined; previously defined by DefineFunc` {
+		t.Errorf("DefineFunc redefinition error = %v", err)
+	}
+	if err := d.DefineFunc("bad a? b", nil); err == nil {
+		t.Error("DefineFunc with misordered optional parameter: got nil error")
+	}
+}
+
+func TestTemplateSet(t *testing.T) {
+	fsys := &countingFS{FS: fstest.MapFS{
+		"common.linebased": &fstest.MapFile{Data: []byte("define say text\n\techo $text\n")},
+		"greet.linebased":  &fstest.MapFile{Data: []byte("# Greetings.\ninclude common\n\ndefine greet name\n\tsay hello, $name\n")},
+		"part.linebased":   &fstest.MapFile{Data: []byte("include common\ndefine part name\n\tsay bye, $name\n")},
+		"bad.linebased":    &fstest.MapFile{Data: []byte("define ok\n\techo\necho stray\n")},
+	}}
+	set, err := ParseTemplates(fsys, "greet.linebased", "part.linebased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff.Test(t, t.Errorf, set.Files(), []string{"common.linebased", "greet.linebased", "part.linebased"})
+
+	scripts := fstest.MapFS{
+		"main.linebased":  &fstest.MapFile{Data: []byte("include greet\ngreet Alice\npart Bob\n")},
+		"clash.linebased": &fstest.MapFile{Data: []byte("define say x\n\techo\n")},
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			d := NewExpandingDecoder("main.linebased", scripts)
+			d.SetTemplates(set)
+			var got []string
+			for {
+				expr, err := d.Decode()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got = append(got, expr.String())
+			}
+			diff.Test(t, t.Errorf, got, []string{"echo hello, Alice\n", "echo bye, Bob\n"})
+		})
+	}
+	wg.Wait()
+	if fsys.open != 0 {
+		t.Errorf("%d template files left open", fsys.open)
+	}
+
+	d := NewExpandingDecoder("clash.linebased", scripts)
+	d.SetTemplates(set)
+	_, err = d.Decode()
+	if want := `clash.linebased:1: template "say" redefined; previous define: common.linebased:1`; err == nil || err.Error() != want {
+		t.Errorf("redefinition error = %v, want %q", err, want)
+	}
+
+	_, err = ParseTemplates(fsys, "bad.linebased")
+	if want := "bad.linebased:3: template files may contain only define and include"; err == nil || err.Error() != want {
+		t.Errorf("ParseTemplates(bad) error = %v, want %q", err, want)
+	}
+
+	// A file of the same name as one in the set must be that file.
+	same := fstest.MapFS{
+		"main.linebased":   &fstest.MapFile{Data: []byte("include common\nsay hi\n")},
+		"common.linebased": fsys.FS.(fstest.MapFS)["common.linebased"],
+	}
+	d = NewExpandingDecoder("main.linebased", same)
+	d.SetTemplates(set)
+	if expr, err := d.Decode(); err != nil || expr.String() != "echo hi\n" {
+		t.Errorf("Decode with the same common = %q, %v; want %q", expr.String(), err, "echo hi\n")
+	}
+	other := fstest.MapFS{
+		"main.linebased":   &fstest.MapFile{Data: []byte("include common\nsay hi\n")},
+		"common.linebased": &fstest.MapFile{Data: []byte("define shout text\n\techo $text!\n")},
+	}
+	d = NewExpandingDecoder("main.linebased", other)
+	d.SetTemplates(set)
+	_, err = d.Decode()
+	if want := "main.linebased:1: include: common.linebased is not the file of the same name in the template set"; err == nil || err.Error() != want {
+		t.Errorf("Decode with another common error = %v, want %q", err, want)
+	}
+
+	// A file with the size and modification time of the one in the set is
+	// taken to be that file, without reading it.
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	lib := fstest.MapFS{"lib.linebased": &fstest.MapFile{Data: []byte("define x\n\techo x\n"), ModTime: mtime}}
+	set, err = ParseTemplates(lib, "lib.linebased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unread := fstest.MapFS{
+		"main.linebased": &fstest.MapFile{Data: []byte("include lib\nx\n")},
+		"lib.linebased":  &fstest.MapFile{Data: []byte("not the same file"), ModTime: mtime},
+	}
+	d = NewExpandingDecoder("main.linebased", unread)
+	d.SetTemplates(set)
+	if expr, err := d.Decode(); err != nil || expr.String() != "echo x\n" {
+		t.Errorf("Decode with an unchanged lib = %q, %v; want %q", expr.String(), err, "echo x\n")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// bomb expands to 10^4 expressions.
+	bomb := "define t3 x\n\tout $x\n" +
+		"define t2 x\n" + strings.Repeat("\tt3 $x\n", 10) +
+		"define t1 x\n" + strings.Repeat("\tt2 $x\n", 10) +
+		"define t0 x\n" + strings.Repeat("\tt1 $x\n", 10) +
+		"t0 boom\n"
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		pipe    bool // serve includes as pipes of unknown size
+		limits  Limits
+		wantErr string
+	}{
+		{
+			name:   "expressions",
+			files:  map[string]string{"main.linebased": bomb},
+			limits: Limits{MaxExpressions: 100},
+			wantErr: "main.linebased:36: t3@1: expansion exceeds limit of 100 expressions:\n" +
+				"    main.linebased:36: main@36> t0 boom\n" +
+				"    main.linebased:36: t0@2> t1 boom\n" +
+				"    main.linebased:36: t1@1> t2 boom\n" +
+				"    main.linebased:36: t2@1> t3 boom",
+		},
+		{
+			// Each call of t3 does work but produces nothing.
+			name:   "calls",
+			files:  map[string]string{"main.linebased": strings.Replace(bomb, "\tout $x\n", "\tinclude? nothere\n", 1)},
+			limits: Limits{MaxCalls: 100, MaxExpressions: 100},
+			wantErr: "main.linebased:36: t3@1: expansion exceeds limit of 100 template calls and includes:\n" +
+				"    main.linebased:36: main@36> t0 boom\n" +
+				"    main.linebased:36: t0@1> t1 boom\n" +
+				"    main.linebased:36: t1@5> t2 boom\n" +
+				"    main.linebased:36: t2@7> t3 boom",
+		},
+		{
+			name:   "expressions unlimited",
+			files:  map[string]string{"main.linebased": bomb},
+			limits: Limits{MaxExpressions: 10000},
+		},
+		{
+			name: "call depth",
+			files: map[string]string{"main.linebased": "" +
+				"define c x\n\tout $x\n" +
+				"define b x\n\tc $x\n" +
+				"define a x\n\tb $x\n" +
+				"a 1\n"},
+			limits: Limits{MaxCallDepth: 2},
+			wantErr: "main.linebased:7: b@1: template call depth exceeds limit of 2:\n" +
+				"    main.linebased:7: main@7> a 1\n" +
+				"    main.linebased:7: a@1> b 1\n" +
+				"    main.linebased:7: b@1> c 1",
+		},
+		{
+			name: "expression bytes",
+			files: map[string]string{"main.linebased": "" +
+				"define d x\n\tout $x$x\n" +
+				"define c x\n\td $x$x\n" +
+				"c 12345\n"},
+			limits: Limits{MaxExpressionBytes: 20},
+			wantErr: "main.linebased:5: d@1: expression exceeds limit of 20 bytes:\n" +
+				"    main.linebased:5: main@5> c 12345\n" +
+				"    main.linebased:5: c@1> d 1234512345",
+		},
+		{
+			name: "include depth",
+			files: map[string]string{
+				"main.linebased": "include a\n",
+				"a.linebased":    "include b\n",
+				"b.linebased":    "out b\n",
+			},
+			limits:  Limits{MaxIncludeDepth: 1},
+			wantErr: "a.linebased:1: include depth exceeds limit of 1",
+		},
+		{
+			name: "include bytes",
+			files: map[string]string{
+				"main.linebased": "include a\n",
+				"a.linebased":    "out 0123456789\n",
+			},
+			limits:  Limits{MaxIncludeBytes: 10},
+			wantErr: `main.linebased:1: include: file "a" exceeds limit of 10 bytes`,
+		},
+		{
+			name: "include bytes of unknown size",
+			files: map[string]string{
+				"main.linebased": "include a\n",
+				"a.linebased":    "out 0\nout 0123456789\n",
+			},
+			pipe:    true,
+			limits:  Limits{MaxIncludeBytes: 10},
+			wantErr: `main.linebased:1: include: file "a" exceeds limit of 10 bytes`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := make(fstest.MapFS)
+			for name, data := range tt.files {
+				fsys[name] = &fstest.MapFile{Data: []byte(data)}
+				if tt.pipe && name != "main.linebased" {
+					fsys[name].Mode = fs.ModeNamedPipe
+				}
+			}
+			d := NewExpandingDecoder("main.linebased", fsys)
+			d.SetLimits(tt.limits)
+			var err error
+			for err == nil {
+				_, err = d.Decode()
+			}
+			if tt.wantErr == "" {
+				if err != io.EOF {
+					t.Fatalf("Decode error: %v", err)
+				}
+				return
+			}
+			var exprErr *ExpressionError
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("error %v (%T) is not an ExpressionError", err, err)
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("unexpected error:\n got %q\nwant %q", err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		limits Limits
+		check  func(error) bool
+	}{
+		{
+			name:  "recursion",
+			files: map[string]string{"main.linebased": "define a\n\tb\ndefine b\n\ta\na\n"},
+			check: func(err error) bool { return errors.Is(err, ErrRecursion) },
+		},
+		{
+			name:  "nested define",
+			files: map[string]string{"main.linebased": "define a x\n\t$x b\na define\n"},
+			check: func(err error) bool { return errors.Is(err, ErrNestedDefine) },
+		},
+		{
+			name:  "arity",
+			files: map[string]string{"main.linebased": "define a x y?\n\tout $x $y?\na\n"},
+			check: func(err error) bool {
+				var e *ArityError
+				return errors.As(err, &e) && *e == ArityError{Template: "a", Want: 1, Got: 0, AtLeast: true}
+			},
+		},
+		{
+			name:  "unknown parameter",
+			files: map[string]string{"main.linebased": "define a x\n\tout $y\na 1\n"},
+			check: func(err error) bool {
+				var e *UnknownParameterError
+				return errors.As(err, &e) && *e == UnknownParameterError{Template: "a", Name: "y"}
+			},
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"main.linebased": "include a\n",
+				"a.linebased":    "include main\n",
+			},
+			check: func(err error) bool {
+				var e *IncludeCycleError
+				return errors.As(err, &e) && slices.Equal(e.Chain, []string{"main.linebased", "a.linebased", "main.linebased"})
+			},
+		},
+		{
+			name:  "redefinition",
+			files: map[string]string{"main.linebased": "define a\n\tout\n\ndefine a\n\tout\n"},
+			check: func(err error) bool {
+				var e *RedefinitionError
+				return errors.As(err, &e) && e.Template == "a" && e.Previous.Line == 1 && !e.Func
+			},
+		},
+		{
+			name:   "limit",
+			files:  map[string]string{"main.linebased": "define a\n\tb\ndefine b\n\tout\na\n"},
+			limits: Limits{MaxCallDepth: 1},
+			check: func(err error) bool {
+				var e *LimitError
+				return errors.As(err, &e) && e.Limit == "MaxCallDepth" && e.Value == 1
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := make(fstest.MapFS)
+			for name, data := range tt.files {
+				fsys[name] = &fstest.MapFile{Data: []byte(data)}
+			}
+			d := NewExpandingDecoder("main.linebased", fsys)
+			d.SetLimits(tt.limits)
+			var err error
+			for err == nil {
+				_, err = d.Decode()
+			}
+			var exprErr *ExpressionError
+			if !errors.As(err, &exprErr) || !tt.check(exprErr.Err) {
+				t.Errorf("unexpected error %v (%T)", err, err)
+			}
+		})
+	}
+
+	d := NewExpandingDecoder("main.linebased", fstest.MapFS{"main.linebased": &fstest.MapFile{}})
+	fn := func(Expanded, Args) ([]Expression, error) { return nil, nil }
+	if err := d.DefineFunc("f", fn); err != nil {
+		t.Fatal(err)
+	}
+	var e *RedefinitionError
+	if err := d.DefineFunc("f x", fn); !errors.As(err, &e) || !e.Func {
+		t.Errorf("DefineFunc twice: error %v; want RedefinitionError with Func set", err)
+	}
+}
+
+func TestExpandingDecoderRecover(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.linebased": &fstest.MapFile{Data: []byte("" +
+			"define greet name\n" +
+			"\tout hello $name\n" +
+			"define broken x\n" +
+			"\tout before\n" +
+			"\tout $y\n" +
+			"\tout after\n" +
+			"include lib\n" +
+			"greet\n" +
+			" bad\n" +
+			"broken 1\n" +
+			"greet bob\n" +
+			"define greet x\n" +
+			"\tout\n" +
+			"include missing\n" +
+			"lib 1\n" +
+			"lib 2\n" +
+			"out end\n",
+		)},
+		"lib.linebased": &fstest.MapFile{Data: []byte("" +
+			"define lib x\n" +
+			"\tout lib $x\n" +
+			"\t bad\n" +
+			" oops\n",
+		)},
+	}
+	d := NewExpandingDecoder("main.linebased", fsys)
+	d.SetRecover(true)
+
+	var got []string
+	var err error
+	for {
+		var expr Expanded
+		expr, err = d.Decode()
+		if err != nil {
+			break
+		}
+		got = append(got, expr.String())
+	}
+	want := []string{"out before\n", "out hello bob\n", "out lib 1\n", "out lib 2\n", "out end\n"}
+	diff.Test(t, t.Errorf, got, want)
+
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("err = %v; want ErrorList", err)
+	}
+	var msgs []string
+	for _, err := range list {
+		msgs = append(msgs, err.Error())
+	}
+	wantMsgs := []string{
+		"lib.linebased:2: unexpected whitespace at start of line", // in the body of lib, reported once
+		"lib.linebased:4: unexpected whitespace at start of line",
+		"main.linebased:3: unknown parameter reference: \"y\"",
+		`main.linebased:8: template "greet" expects 1 arguments, got 0`,
+		"main.linebased:9: unexpected whitespace at start of line",
+		`main.linebased:12: template "greet" redefined; previous define: main.linebased:1`,
+		"main.linebased:14: open missing.linebased: file does not exist",
+	}
+	diff.Test(t, t.Errorf, msgs, wantMsgs)
+	if _, err2 := d.Decode(); err2.Error() != err.Error() {
+		t.Errorf("second Decode error = %v; want sticky %v", err2, err)
+	}
+}
+
+func TestExpandingDecoderRecoverLimit(t *testing.T) {
+	fsys := fstest.MapFS{"main.linebased": &fstest.MapFile{Data: []byte(
+		"a\nb\n c\nd\ne\nf\n",
+	)}}
+	d := NewExpandingDecoder("main.linebased", fsys)
+	d.SetRecover(true)
+	d.SetLimits(Limits{MaxExpressions: 3})
+	var err error
+	for err == nil {
+		_, err = d.Decode()
+	}
+	var list ErrorList
+	var limitErr *LimitError
+	if !errors.As(err, &list) || len(list) != 2 || !errors.As(list[1], &limitErr) {
+		t.Fatalf("err = %v; want ErrorList of syntax error and limit error", err)
+	}
+}
+
+func TestExpandingDecoderRecoverRecursion(t *testing.T) {
+	fsys := fstest.MapFS{"main.linebased": &fstest.MapFile{Data: []byte("" +
+		"define greet name\n" +
+		"\tout hello $name\n" +
+		"define loop\n" +
+		"\tloop\n" +
+		"loop\n" +
+		"define w\n" +
+		"\tgreet\n" +
+		"w\n" +
+		"out after\n",
+	)}}
+	d := NewExpandingDecoder("main.linebased", fsys)
+	d.SetRecover(true)
+
+	var got []Expanded
+	var err error
+	for {
+		var expr Expanded
+		expr, err = d.Decode()
+		if err != nil {
+			break
+		}
+		got = append(got, expr)
+	}
+	if len(got) != 1 || got[0].String() != "out after\n" {
+		t.Fatalf("got %q; want only out after", got)
+	}
+	if len(got[0].Stack) != 0 {
+		t.Errorf("stack after recursion = %v; want empty", got[0].Stack)
+	}
+
+	var list ErrorList
+	if !errors.As(err, &list) || len(list) != 2 {
+		t.Fatalf("err = %v; want ErrorList of 2 errors", err)
+	}
+	if !errors.Is(list[0], ErrRecursion) {
+		t.Errorf("first error = %v; want ErrRecursion", list[0])
+	}
+	want := `main.linebased:8: w@1: template "greet" expects 1 arguments, got 0`
+	if msg := list[1].Error(); msg != want {
+		t.Errorf("second error = %q; want %q", msg, want)
+	}
+}
+
+func TestExpandClosesFiles(t *testing.T) {
+	fsys := &countingFS{FS: fstest.MapFS{
+		"main.lb":       &fstest.MapFile{Data: []byte("include lib\necho after\n")},
+		"lib.linebased": &fstest.MapFile{Data: []byte("echo one\necho two\n")},
+	}}
+
+	// Break out of the loop while the include is still open.
+	for expr, err := range Expand("main.lb", fsys) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expr.Name == "echo" {
+			break
+		}
+	}
+	if fsys.open != 0 {
+		t.Errorf("after break: %d files open, want 0", fsys.open)
+	}
+
+	// Stop with an error while the include is still open.
+	fsys.FS.(fstest.MapFS)["lib.linebased"] = &fstest.MapFile{Data: []byte("echo one\n bad\n")}
+	var gotErr error
+	for _, err := range Expand("main.lb", fsys) {
+		gotErr = err
+	}
+	if gotErr == nil {
+		t.Fatal("expected error")
+	}
+	if fsys.open != 0 {
+		t.Errorf("after error: %d files open, want 0", fsys.open)
+	}
+}
+
+// countingFS tracks the number of files opened but not yet closed.
+type countingFS struct {
+	fs.FS
+	open int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c.open++
+	return &countingFile{File: f, fs: c}, nil
+}
+
+type countingFile struct {
+	fs.File
+	fs *countingFS
+}
+
+func (f *countingFile) Close() error {
+	f.fs.open--
+	return f.File.Close()
+}
+
+func TestExpandInclude(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"main.linebased":  &fstest.MapFile{Data: []byte("include other\n")},
+			"other.linebased": &fstest.MapFile{Data: []byte("define echo tail\necho hi\n")},
+		}
+
+		var got []string
+		d := NewExpandingDecoder("main.linebased", fsys)
+		for {
+			expr, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Expanded error: %v", err)
+			}
+			if expr.Name == "" {
+				continue
+			}
+			got = append(got, expr.String())
+		}
+
+		want := []string{"echo hi\n"}
+		if !slices.Equal(got, want) {
+			t.Fatalf("include output: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("subdirectory", func(t *testing.T) {
+		// Nested includes are rooted at fsys, not at the including file.
+		fsys := fstest.MapFS{
+			"main.linebased":         &fstest.MapFile{Data: []byte("include lib/http\nget /\n")},
+			"lib/http.linebased":     &fstest.MapFile{Data: []byte("include lib/net/dial\ndefine get path\n\tdial $path\n")},
+			"lib/net/dial.linebased": &fstest.MapFile{Data: []byte("define dial addr\n\tconnect $addr\n")},
+		}
+
+		var got []string
+		d := NewExpandingDecoder("main.linebased", fsys)
+		for {
+			expr, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Expanded error: %v", err)
+			}
+			if expr.Name == "" {
+				continue
+			}
+			got = append(got, expr.Where()+" "+expr.String())
+		}
+
+		want := []string{"main.linebased:2: dial@1 connect /\n"}
+		if !slices.Equal(got, want) {
+			t.Fatalf("include output: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("search path", func(t *testing.T) {
+		project := fstest.MapFS{
+			"main.linebased": &fstest.MapFile{Data: []byte("include http\ninclude log\nget\ninfo\n")},
+		}
+		vendor := fstest.MapFS{
+			"http.linebased": &fstest.MapFile{Data: []byte("define get\n\techo vendored get\n")},
+		}
+		std := fstest.MapFS{
+			"http.linebased": &fstest.MapFile{Data: []byte("define get\n\techo std get\n")},
+			"log.linebased":  &fstest.MapFile{Data: []byte("define info\n\techo std info\n")},
+		}
+
+		var got []string
+		d := NewExpandingDecoder("main.linebased", project)
+		d.SetIncludePath(vendor, std)
+		for {
+			expr, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Expanded error: %v", err)
+			}
+			if expr.Name == "" {
+				continue
+			}
+			got = append(got, expr.String())
+		}
+
+		want := []string{"echo vendored get\n", "echo std info\n"}
+		if !slices.Equal(got, want) {
+			t.Fatalf("include output: got %q, want %q", got, want)
+		}
+
+		// A file found nowhere reports the error from the first root.
+		project["main.linebased"] = &fstest.MapFile{Data: []byte("include missing\n")}
+		d = NewExpandingDecoder("main.linebased", project)
+		d.SetIncludePath(vendor, std)
+		var err error
+		for err == nil {
+			_, err = d.Decode()
+		}
+		want2 := "main.linebased:1: open missing.linebased: file does not exist"
+		if err == io.EOF || err.Error() != want2 {
+			t.Fatalf("missing include: got %v, want %q", err, want2)
+		}
+	})
+
+	t.Run("optional", func(t *testing.T) {
+		// A missing optional include is skipped, but errors in one that
+		// exists are reported.
+		fsys := fstest.MapFS{
+			"main.linebased":  &fstest.MapFile{Data: []byte("include? absent\ninclude? local\necho done\n")},
+			"local.linebased": &fstest.MapFile{Data: []byte("echo local\n  oops\n")},
+		}
+		var got []string
+		var err error
+		d := NewExpandingDecoder("main.linebased", fsys)
+		for {
+			var expr Expanded
+			expr, err = d.Decode()
+			if err != nil {
+				break
+			}
+			got = append(got, expr.String())
+		}
+		if want := []string{"echo local\n"}; !slices.Equal(got, want) {
+			t.Errorf("include? output: got %q, want %q", got, want)
+		}
+		want := "local.linebased:2: unexpected whitespace at start of line"
+		if err == nil || err.Error() != want {
+			t.Fatalf("include? error: got %v, want %q", err, want)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"main.lb": &fstest.MapFile{Data: []byte("include missing\n")},
+		}
+		var gotErr error
+		d := NewExpandingDecoder("main.lb", fsys)
+		for {
+			_, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				gotErr = err
+				break
+			}
+		}
+
+		if gotErr == nil {
+			t.Fatalf("expected error for missing include, got nil")
+		}
+		var pe *fs.PathError
+		if !errors.As(gotErr, &pe) {
+			t.Fatalf("expected PathError, got %T: %v", gotErr, gotErr)
+		}
+		if pe.Path != "missing.linebased" {
+			t.Fatalf("unexpected PathError path: %q", pe.Path)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"main.linebased": &fstest.MapFile{Data: []byte("include a\n")},
+			"a.linebased":    &fstest.MapFile{Data: []byte("include b\n")},
+			"b.linebased":    &fstest.MapFile{Data: []byte("include a\n")},
+		}
+		var gotErr error
+		d := NewExpandingDecoder("main.lb", fsys)
+		for {
+			_, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				gotErr = err
+				break
+			}
+		}
+
+		if gotErr == nil {
+			t.Fatalf("expected cycle error, got nil")
 		}
-		want := "b.linebased:1: include cycle detected: main.lb -> a.linebased -> b.linebased -> a.linebased"
+		want := "b.linebased:1: include cycle detected: main.linebased -> a.linebased -> b.linebased -> a.linebased"
 		if gotErr.Error() != want {
 			t.Fatalf("unexpected cycle error:\n got %q\nwant %q", gotErr.Error(), want)
 		}
 	})
 
-	t.Run("slash in path", func(t *testing.T) {
-		fsys := fstest.MapFS{
-			"main.lb": &fstest.MapFile{Data: []byte("include foo/bar\n")},
+	t.Run("path outside root", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"lib/main.lb":   &fstest.MapFile{Data: []byte("include ../bar\n")},
+			"bar.linebased": &fstest.MapFile{Data: []byte("echo secret\n")},
+		}
+		var gotErr error
+		d := NewExpandingDecoder("lib/main.lb", fsys)
+		for {
+			_, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				gotErr = err
+				break
+			}
+		}
+
+		if gotErr == nil {
+			t.Fatalf("expected error for path outside root, got nil")
+		}
+		want := `lib/main.lb:1: include: invalid path "../bar"; paths are relative to the include root and may not contain ".", "..", or empty elements`
+		if gotErr.Error() != want {
+			t.Fatalf("unexpected error:\n got %q\nwant %q", gotErr.Error(), want)
+		}
+	})
+
+	t.Run("linebased extension", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"main.lb": &fstest.MapFile{Data: []byte("include foo.linebased\n")},
+		}
+		var gotErr error
+		d := NewExpandingDecoder("main.lb", fsys)
+		for {
+			_, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				gotErr = err
+				break
+			}
+		}
+
+		if gotErr == nil {
+			t.Fatalf("expected error for .linebased extension, got nil")
+		}
+		want := `main.lb:1: include: path "foo.linebased" has .linebased extension; the extension is not required and will be added automatically`
+		if gotErr.Error() != want {
+			t.Fatalf("unexpected error:\n got %q\nwant %q", gotErr.Error(), want)
+		}
+	})
+}
+
+// mapResolver resolves includes from a map of file contents keyed by name.
+// Names listed in alias resolve to the file with the aliased name.
+type mapResolver struct {
+	files map[string]string
+	alias map[string]string
+	calls []string // "from -> name" for each call to Resolve
+}
+
+func (r *mapResolver) Resolve(name, from string) (string, io.ReadCloser, error) {
+	r.calls = append(r.calls, from+" -> "+name)
+	if target, ok := r.alias[name]; ok {
+		name = target
+	}
+	text, ok := r.files[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no file %q", name)
+	}
+	return "mem:" + name, io.NopCloser(strings.NewReader(text)), nil
+}
+
+func TestResolver(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.linebased": &fstest.MapFile{Data: []byte("include lib/a\ngreet\ndefine greet\n\techo hi\n")},
+	}
+	r := &mapResolver{files: map[string]string{
+		"lib/a.linebased": "include lib/b\n",
+		"lib/b.linebased": "\ndefine greet\n\techo hello\n",
+	}}
+
+	var got []string
+	d := NewExpandingDecoder("main.linebased", fsys)
+	d.SetResolver(r)
+	var err error
+	for {
+		var expr Expanded
+		expr, err = d.Decode()
+		if err != nil {
+			break
+		}
+		if expr.Name != "" {
+			got = append(got, expr.String())
+		}
+	}
+	if want := []string{"echo hello\n"}; !slices.Equal(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	// Files are known by their identity.
+	if want := `main.linebased:3: template "greet" redefined; previous define: mem:lib/b.linebased:2`; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+	wantCalls := []string{
+		"main.linebased -> lib/a.linebased",
+		"mem:lib/a.linebased -> lib/b.linebased",
+	}
+	if !slices.Equal(r.calls, wantCalls) {
+		t.Errorf("Resolve calls = %q, want %q", r.calls, wantCalls)
+	}
+
+	t.Run("cycle by identity", func(t *testing.T) {
+		r := &mapResolver{
+			files: map[string]string{"a.linebased": "include self\n"},
+			alias: map[string]string{"self.linebased": "a.linebased"},
+		}
+		d := NewExpandingDecoder("main.linebased", fstest.MapFS{
+			"main.linebased": &fstest.MapFile{Data: []byte("include a\n")},
+		})
+		d.SetResolver(r)
+		_, err := d.Decode()
+		var cycle *IncludeCycleError
+		if !errors.As(err, &cycle) {
+			t.Fatalf("Decode error = %v, want IncludeCycleError", err)
+		}
+		want := []string{"main.linebased", "mem:a.linebased", "mem:a.linebased"}
+		if !slices.Equal(cycle.Chain, want) {
+			t.Errorf("Chain = %q, want %q", cycle.Chain, want)
+		}
+	})
+
+	t.Run("cycle through extension fallback", func(t *testing.T) {
+		// main.lb is read from main.linebased, which "include main" reads
+		// again.
+		d := NewExpandingDecoder("main.lb", fstest.MapFS{
+			"main.linebased": &fstest.MapFile{Data: []byte("include main\n")},
+		})
+		_, err := d.Decode()
+		var cycle *IncludeCycleError
+		if !errors.As(err, &cycle) {
+			t.Fatalf("Decode error = %v, want IncludeCycleError", err)
+		}
+		want := []string{"main.linebased", "main.linebased"}
+		if !slices.Equal(cycle.Chain, want) {
+			t.Errorf("Chain = %q, want %q", cycle.Chain, want)
+		}
+	})
+}
+
+func TestPrivateTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib.linebased": &fstest.MapFile{Data: []byte(
+			"define _helper x\n\techo lib $x\n" +
+				"define pub x\n\t_helper $x\n")},
+		"main.linebased": &fstest.MapFile{Data: []byte(
+			"include lib\n" +
+				"define _helper x\n\tpub $x\n" +
+				"pub 1\n" +
+				"_helper 2\n")},
+	}
+	var got []string
+	d := NewExpandingDecoder("main.linebased", fsys)
+	for {
+		expr, err := d.Decode()
+		if err == io.EOF {
+			break
 		}
-		var gotErr error
-		d := NewExpandingDecoder("main.lb", fsys)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if expr.Name != "" {
+			got = append(got, expr.String())
+		}
+	}
+	// The _helper of main calls pub, which calls the _helper of lib; that
+	// is not recursion.
+	want := []string{"echo lib 1\n", "echo lib 2\n"}
+	if !slices.Equal(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	t.Run("not visible", func(t *testing.T) {
+		fsys := maps.Clone(fsys)
+		fsys["main.linebased"] = &fstest.MapFile{Data: []byte("include lib\n_helper 1\n_other 2\n")}
+		d := NewExpandingDecoder("main.linebased", fsys)
+		d.SetRecover(true)
+		var got []string
+		var err error
 		for {
-			_, err := d.Decode()
-			if err == io.EOF {
-				break
-			}
+			var expr Expanded
+			expr, err = d.Decode()
 			if err != nil {
-				gotErr = err
 				break
 			}
+			if expr.Name != "" {
+				got = append(got, expr.String())
+			}
 		}
-
-		if gotErr == nil {
-			t.Fatalf("expected error for path with slash, got nil")
+		// An underscore name that no file defines is not a template.
+		if want := []string{"_other 2\n"}; !slices.Equal(got, want) {
+			t.Errorf("output = %q, want %q", got, want)
 		}
-		want := `main.lb:1: include: path "foo/bar" contains '/'; only root-level includes are allowed`
-		if gotErr.Error() != want {
-			t.Fatalf("unexpected error:\n got %q\nwant %q", gotErr.Error(), want)
+		want := `main.linebased:2: template "_helper" is private to lib.linebased`
+		if err == nil || err.Error() != want {
+			t.Errorf("error = %v, want %q", err, want)
 		}
 	})
 
-	t.Run("linebased extension", func(t *testing.T) {
+	t.Run("redefined", func(t *testing.T) {
 		fsys := fstest.MapFS{
-			"main.lb": &fstest.MapFile{Data: []byte("include foo.linebased\n")},
+			"main.linebased": &fstest.MapFile{Data: []byte("define _a\n\techo 1\ndefine _a\n\techo 2\n")},
 		}
-		var gotErr error
-		d := NewExpandingDecoder("main.lb", fsys)
+		_, err := NewExpandingDecoder("main.linebased", fsys).Decode()
+		var e *RedefinitionError
+		if !errors.As(err, &e) || e.Template != "_a" {
+			t.Errorf("Decode error = %v, want RedefinitionError for _a", err)
+		}
+	})
+
+	t.Run("template set", func(t *testing.T) {
+		set, err := ParseTemplates(fsys, "lib.linebased")
+		if err != nil {
+			t.Fatal(err)
+		}
+		main := fstest.MapFS{
+			"main.linebased": &fstest.MapFile{Data: []byte("include lib\npub 1\n_helper 2\n")},
+		}
+		var got []string
+		d := NewExpandingDecoder("main.linebased", main)
+		d.SetTemplates(set)
 		for {
-			_, err := d.Decode()
-			if err == io.EOF {
-				break
-			}
+			var expr Expanded
+			expr, err = d.Decode()
 			if err != nil {
-				gotErr = err
 				break
 			}
+			if expr.Name != "" {
+				got = append(got, expr.String())
+			}
 		}
-
-		if gotErr == nil {
-			t.Fatalf("expected error for .linebased extension, got nil")
+		if want := []string{"echo lib 1\n"}; !slices.Equal(got, want) {
+			t.Errorf("output = %q, want %q", got, want)
 		}
-		want := `main.lb:1: include: path "foo.linebased" has .linebased extension; the extension is not required and will be added automatically`
-		if gotErr.Error() != want {
-			t.Fatalf("unexpected error:\n got %q\nwant %q", gotErr.Error(), want)
+		want := `main.linebased:3: template "_helper" is private to lib.linebased`
+		if err == nil || err.Error() != want {
+			t.Errorf("error = %v, want %q", err, want)
+		}
+	})
+
+	t.Run("DefineFunc", func(t *testing.T) {
+		d := NewExpandingDecoder("main.linebased", fsys)
+		err := d.DefineFunc("_f", func(Expanded, Args) ([]Expression, error) { return nil, nil })
+		if err == nil {
+			t.Error("DefineFunc of a private template succeeded")
 		}
 	})
 }
@@ -508,7 +1884,7 @@ func TestExpandInclude(t *testing.T) {
 func TestNestedTemplateOrdering(t *testing.T) {
 	// Test that nested template expansions are yielded in the correct order.
 	// Previously, when a template called another template, the inner template's
-	// expressions were queued to d.pending before the outer template finished,
+	// expressions were queued for later before the outer template finished,
 	// causing expressions to be yielded in the wrong order.
 	const script = `define inner p
 	first $p
@@ -547,6 +1923,46 @@ outer test
 	}
 }
 
+func TestLazyExpansion(t *testing.T) {
+	// t0 expands to 10^4 expressions, and broken fails only after it has
+	// produced its first expression.
+	script := "define t4 x\n\tout $x\n"
+	for i := 3; i >= 0; i-- {
+		script += fmt.Sprintf("define t%d x\n", i) + strings.Repeat(fmt.Sprintf("\tt%d $x\n", i+1), 10)
+	}
+	script += "t0 go\nt0 bad\n"
+	script += "define broken x\n\tfirst $x\n\tsecond $y\nbroken 1\n"
+	fsys := fstest.MapFS{"main.linebased": &fstest.MapFile{Data: []byte(script)}}
+	d := NewExpandingDecoder("main.linebased", fsys)
+
+	var n int
+	var first bool
+	for {
+		expr, err := d.Decode()
+		if err != nil {
+			if !strings.Contains(err.Error(), `unknown parameter reference: "y"`) {
+				t.Fatalf("Decode error: %v", err)
+			}
+			break
+		}
+		if len(d.decoderStack) > 6 || len(d.callStack.frames) > 5 {
+			t.Fatalf("after %d expressions: %d decoders and %d calls in progress", n, len(d.decoderStack), len(d.callStack.frames))
+		}
+		if expr.Name == "out" {
+			n++
+		}
+		if expr.Name == "first" {
+			first = true
+			if n != 2e4 {
+				t.Fatalf("first expression of broken template after %d expressions; want %d", n, int(2e4))
+			}
+		}
+	}
+	if !first {
+		t.Error("broken template produced no expressions before its error")
+	}
+}
+
 func TestTemplateOptionalParams(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -661,6 +2077,226 @@ func TestTemplateOptionalParams(t *testing.T) {
 	}
 }
 
+func TestTemplateVariadicParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "joined",
+			script: "" +
+				"define run cmd args...\n" +
+				"\tout $cmd $args\n" +
+				"run ls -l   -a\n",
+			want: []string{"out ls -l -a\n"},
+		},
+		{
+			name: "one expression per element",
+			script: "" +
+				"define deploy app hosts...\n" +
+				"\techo deploying $app\n" +
+				"\tssh $hosts... restart $app\n" +
+				"deploy web a b\n",
+			want: []string{"echo deploying web\n", "ssh a restart web\n", "ssh b restart web\n"},
+		},
+		{
+			name: "braced element reference",
+			script: "" +
+				"define pingall hosts...\n" +
+				"\tping ${hosts...}.local of $hosts\n" +
+				"pingall a b\n",
+			want: []string{"ping a.local of a b\n", "ping b.local of a b\n"},
+		},
+		{
+			name: "no variadic arguments",
+			script: "" +
+				"define run cmd args...\n" +
+				"\tout $cmd\n" +
+				"\teach $args...\n" +
+				"run ls\n",
+			want: []string{"out ls\n"},
+		},
+		{
+			name: "after optional",
+			script: "" +
+				"define f a? rest...\n" +
+				"\tout $a? | $rest\n" +
+				"f x y z\n",
+			want: []string{"out x | y z\n"},
+		},
+		{
+			name: "ellipsis after non-variadic param stays punctuation",
+			script: "" +
+				"define f a\n" +
+				"\tout $a...\n" +
+				"f x\n",
+			want: []string{"out x...\n"},
+		},
+		{
+			name: "required omitted before variadic",
+			script: "" +
+				"define run cmd args...\n" +
+				"\tout $cmd\n" +
+				"run\n",
+			wantErr: `test.lb:3: template "run" expects at least 1 arguments, got 0`,
+		},
+		{
+			name:    "variadic not last",
+			script:  "define bad a... b\n\tout\n",
+			wantErr: `test.lb:1: define: variadic parameter "a..." must be last`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"test.lb": &fstest.MapFile{Data: []byte(tt.script)}}
+			d := NewExpandingDecoder("test.lb", fsys)
+
+			var got []string
+			var gotErr error
+			for {
+				expr, err := d.Decode()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					gotErr = err
+					break
+				}
+				if expr.Name == "" {
+					continue
+				}
+				got = append(got, expr.String())
+			}
+
+			if tt.wantErr != "" {
+				if gotErr == nil {
+					t.Fatalf("expected error %q, got nil", tt.wantErr)
+				}
+				if gotErr.Error() != tt.wantErr {
+					t.Fatalf("unexpected error:\n got %q\nwant %q", gotErr.Error(), tt.wantErr)
+				}
+				return
+			}
+			if gotErr != nil {
+				t.Fatalf("Decode error: %v", gotErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expanded output:\n got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateDefaultParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "default used",
+			script: "" +
+				"define greet name title?=friend\n" +
+				"\techo Hello, $title? $name\n" +
+				"greet Alice\n" +
+				"greet Bob Dr.\n",
+			want: []string{"echo Hello, friend Alice\n", "echo Hello, Dr. Bob\n"},
+		},
+		{
+			name: "braced reference",
+			script: "" +
+				"define f a?=x b?=y\n" +
+				"\tout ${a?}${b?}\n" +
+				"f\n" +
+				"f 1\n",
+			want: []string{"out xy\n", "out 1y\n"},
+		},
+		{
+			name: "empty default",
+			script: "" +
+				"define f a?=\n" +
+				"\tout [$a?]\n" +
+				"f\n",
+			want: []string{"out []\n"},
+		},
+		{
+			name: "default is not expanded",
+			script: "" +
+				"define f a b?=$a\n" +
+				"\tout $b?\n" +
+				"f 1\n",
+			want: []string{"out $a\n"},
+		},
+		{
+			name: "before variadic",
+			script: "" +
+				"define run cmd?=ls args...\n" +
+				"\tout $cmd? $args\n" +
+				"run\n",
+			want: []string{"out ls \n"},
+		},
+		{
+			name:    "default on required parameter",
+			script:  "define bad a=1\n\tout\n",
+			wantErr: `test.lb:1: define: parameter "a=1" has a default value but is not optional`,
+		},
+		{
+			name:    "default on variadic parameter",
+			script:  "define bad a...=1\n\tout\n",
+			wantErr: `test.lb:1: define: parameter "a...=1" has a default value but is not optional`,
+		},
+		{
+			name:    "required after default",
+			script:  "define bad a?=1 b\n\tout\n",
+			wantErr: `test.lb:1: define: required parameter "b" follows optional parameter "a?=1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"test.lb": &fstest.MapFile{Data: []byte(tt.script)}}
+			d := NewExpandingDecoder("test.lb", fsys)
+
+			var got []string
+			var gotErr error
+			for {
+				expr, err := d.Decode()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					gotErr = err
+					break
+				}
+				if expr.Name == "" {
+					continue
+				}
+				got = append(got, expr.String())
+			}
+
+			if tt.wantErr != "" {
+				if gotErr == nil {
+					t.Fatalf("expected error %q, got nil", tt.wantErr)
+				}
+				if gotErr.Error() != tt.wantErr {
+					t.Fatalf("unexpected error:\n got %q\nwant %q", gotErr.Error(), tt.wantErr)
+				}
+				return
+			}
+			if gotErr != nil {
+				t.Fatalf("Decode error: %v", gotErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expanded output:\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestTemplateOptionalParamOrder(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -837,3 +2473,108 @@ func TestExpandingDecoder(t *testing.T) {
 		})
 	}
 }
+
+// FuzzCompilePlan checks that compiled substitutions agree with os.Expand,
+// which expanded template bodies before they were compiled.
+func FuzzCompilePlan(f *testing.F) {
+	f.Add("x? rest...", "echo $x? ${x?} $$rest... $rest $1 ${} ${a $")
+	f.Add("a b?=1", "$a$b?${a}${$}$")
+	f.Fuzz(func(t *testing.T, decl, s string) {
+		if strings.Contains(decl, "\n") {
+			return
+		}
+		tmpl, err := makeTemplate(Expanded{Expression: Expression{Name: "define", Body: "f " + decl}})
+		if err != nil {
+			return
+		}
+		n := len(tmpl.params)
+		args := tmpl.bind(callArgs("one two three four five", n))
+		var rest []string
+		if tmpl.params.variadic() {
+			rest = args[n-1:]
+		}
+
+		var wantUnknown string
+		want := os.Expand(tmpl.braceOptionalRefs(s), func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			if tmpl.params.variadic() {
+				switch v := tmpl.params[n-1].name(); name {
+				case v:
+					return "elem"
+				case strings.TrimSuffix(v, "..."):
+					return strings.Join(rest, " ")
+				}
+			}
+			if i := tmpl.params.index(name); i >= 0 {
+				return args.At(i)
+			}
+			if wantUnknown == "" {
+				wantUnknown = name
+			}
+			return ""
+		})
+
+		p, unknown := tmpl.compilePlan(s)
+		if got := p.expand(args, rest, "elem"); got != want {
+			t.Errorf("expand %q with params %q:\n got %q\nwant %q", s, tmpl.params, got, want)
+		}
+		if unknown != wantUnknown {
+			t.Errorf("unknown reference in %q = %q; want %q", s, unknown, wantUnknown)
+		}
+	})
+}
+
+func BenchmarkExpand(b *testing.B) {
+	benchmarks := []struct {
+		name   string
+		define string
+		call   string
+	}{
+		{
+			name: "plain",
+			define: "define deploy app host port?=8080\n" +
+				"\techo deploying $app to $host\n" +
+				"\tssh $host systemctl restart $app\n" +
+				"\tcheck http://${host}:$port?/health\n" +
+				"\techo done\n",
+			call: "deploy web host%d.example\n",
+		},
+		{
+			name: "variadic",
+			define: "define pingall hosts...\n" +
+				"\techo pinging $hosts\n" +
+				"\tping -c 1 $hosts...\n",
+			call: "pingall a%d b c d\n",
+		},
+		{
+			name: "nested",
+			define: "define inner x\n" +
+				"\tout $x\n" +
+				"define outer x\n" +
+				"\tinner $x.1\n" +
+				"\tinner $x.2\n",
+			call: "outer %d\n",
+		},
+	}
+	for _, bb := range benchmarks {
+		var script strings.Builder
+		script.WriteString(bb.define)
+		for i := range 10000 {
+			fmt.Fprintf(&script, bb.call, i)
+		}
+		fsys := fstest.MapFS{"main.linebased": &fstest.MapFile{Data: []byte(script.String())}}
+		b.Run(bb.name, func(b *testing.B) {
+			b.SetBytes(int64(script.Len()))
+			b.ReportAllocs()
+			for b.Loop() {
+				for _, err := range Expand("main.linebased", fsys) {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package linebased
+
+import (
+	"cmp"
+	"strings"
+)
+
+// A bodyExpr is an expression of a template body with the substitution of
+// parameters compiled into its name and body.
+type bodyExpr struct {
+	Expression
+
+	name, body plan
+	elements   bool   // refers to the elements of a variadic parameter
+	unknown    string // first reference to an unknown parameter, if any
+}
+
+// A plan is a string with its parameter references resolved: a sequence
+// of literal text and references, expanded by concatenation.
+type plan []segment
+
+// A segment is literal text or a reference to a parameter.
+type segment struct {
+	lit string
+	ref int // index of the parameter, or one of refNone, refList, refElem
+}
+
+const (
+	refNone = -1 - iota // literal text
+	refList             // the variadic arguments, joined by spaces
+	refElem             // the current variadic argument
+)
+
+// compile compiles the substitution of the parameters of t into expr.
+func (t template) compile(expr Expression) bodyExpr {
+	x := bodyExpr{Expression: expr}
+	var nameUnknown, bodyUnknown string
+	x.name, nameUnknown = t.compilePlan(expr.Name)
+	x.body, bodyUnknown = t.compilePlan(expr.Body)
+	x.unknown = cmp.Or(nameUnknown, bodyUnknown)
+	x.elements = x.name.refers(refElem) || x.body.refers(refElem)
+	return x
+}
+
+// compilePlan compiles the parameter references in s. It reports the first
+// reference to a name that is not a parameter of t, which expands to the
+// empty string.
+//
+// References are recognized exactly as [os.Expand] recognizes them, after
+// optional and variadic references are braced.
+func (t template) compilePlan(s string) (p plan, unknown string) {
+	s = t.braceOptionalRefs(s)
+	var lit strings.Builder
+	i := 0
+	for j := 0; j < len(s); j++ {
+		if s[j] != '$' || j+1 == len(s) {
+			continue
+		}
+		lit.WriteString(s[i:j])
+		name, w := shellName(s[j+1:])
+		switch {
+		case name == "" && w > 0:
+			// Invalid syntax, as in "${}"; drop it.
+		case name == "", name == "$":
+			// A $ not followed by a name, or $$.
+			lit.WriteByte('$')
+		default:
+			ref, ok := t.ref(name)
+			if !ok {
+				if unknown == "" {
+					unknown = name
+				}
+				break
+			}
+			p = p.appendLiteral(lit.String())
+			lit.Reset()
+			p = append(p, segment{ref: ref})
+		}
+		j += w
+		i = j + 1
+	}
+	lit.WriteString(s[i:])
+	return p.appendLiteral(lit.String()), unknown
+}
+
+// ref returns the reference for the parameter of t with the given name.
+func (t template) ref(name string) (int, bool) {
+	if t.params.variadic() {
+		switch v := t.params[len(t.params)-1].name(); name {
+		case v:
+			return refElem, true
+		case strings.TrimSuffix(v, "..."):
+			return refList, true
+		}
+	}
+	if i := t.params.index(name); i >= 0 {
+		return i, true
+	}
+	return 0, false
+}
+
+// shellName returns the name of the reference at the start of s, which
+// follows a $, and the number of bytes it takes, as os.Expand does.
+func shellName(s string) (string, int) {
+	switch {
+	case s[0] == '{':
+		if len(s) > 2 && isShellSpecial(s[1]) && s[2] == '}' {
+			return s[1:2], 3
+		}
+		for i := 1; i < len(s); i++ {
+			if s[i] == '}' {
+				if i == 1 {
+					return "", 2 // "${}"
+				}
+				return s[1:i], i + 1
+			}
+		}
+		return "", 1 // unterminated "${"
+	case isShellSpecial(s[0]):
+		return s[0:1], 1
+	}
+	i := 0
+	for i < len(s) && isNameContinue(s[i]) {
+		i++
+	}
+	return s[:i], i
+}
+
+func isShellSpecial(c byte) bool {
+	return strings.IndexByte("*#$@!?-0123456789", c) >= 0
+}
+
+func (p plan) appendLiteral(lit string) plan {
+	if lit == "" {
+		return p
+	}
+	return append(p, segment{lit: lit, ref: refNone})
+}
+
+// refers reports whether p contains the reference ref.
+func (p plan) refers(ref int) bool {
+	for _, s := range p {
+		if s.ref == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the text of p with args, as returned by bind, substituted
+// for parameter references. References to the variadic parameter expand
+// to rest joined by spaces, and references to its elements to elem.
+func (p plan) expand(args Args, rest []string, elem string) string {
+	switch {
+	case len(p) == 0:
+		return ""
+	case len(p) == 1 && p[0].ref == refNone:
+		return p[0].lit
+	}
+	n := 0
+	for _, s := range p {
+		switch s.ref {
+		case refNone:
+			n += len(s.lit)
+		case refList:
+			for _, arg := range rest {
+				n += len(arg) + 1
+			}
+		case refElem:
+			n += len(elem)
+		default:
+			n += len(args.At(s.ref))
+		}
+	}
+	var b strings.Builder
+	b.Grow(n)
+	for _, s := range p {
+		switch s.ref {
+		case refNone:
+			b.WriteString(s.lit)
+		case refList:
+			for i, arg := range rest {
+				if i > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(arg)
+			}
+		case refElem:
+			b.WriteString(elem)
+		default:
+			b.WriteString(args.At(s.ref))
+		}
+	}
+	return b.String()
+}
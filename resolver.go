@@ -0,0 +1,87 @@
+package linebased
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// A Resolver finds the files read by include. It lets a program serve
+// included files from somewhere other than a file system: an embedded
+// bundle, the unsaved buffers of an editor, or a cache of downloaded
+// libraries.
+type Resolver interface {
+	// Resolve opens the file read by "include name" in the file with the
+	// identity from. The name is a slash-separated path with no ".", "..",
+	// or empty elements, with the .linebased extension added. The identity
+	// of the file the decoder was created with is the name of the file it
+	// opened, so a "main.lb" read from "main.linebased" has the identity
+	// "main.linebased".
+	//
+	// Resolve returns the canonical identity of the file, which the
+	// decoder uses in error messages and to detect include cycles, and
+	// its contents, which the decoder closes when it is done reading. If
+	// the contents have a Stat method, as an [fs.File] does, it is used to
+	// check the size of the file against [Limits].MaxIncludeBytes before
+	// reading.
+	//
+	// If there is no such file, the error should satisfy
+	// errors.Is(err, fs.ErrNotExist), so that "include?" skips it.
+	Resolve(name, from string) (id string, rc io.ReadCloser, err error)
+}
+
+// FSResolver returns a Resolver that opens included files from the first
+// of roots that has them. The identity of a file is its name; the file
+// containing the include makes no difference. If no root has the file,
+// Resolve returns the error from the first.
+func FSResolver(roots ...fs.FS) Resolver {
+	return fsResolver(roots)
+}
+
+type fsResolver []fs.FS
+
+func (roots fsResolver) Resolve(name, from string) (string, io.ReadCloser, error) {
+	var err error
+	for _, root := range roots {
+		f, err1 := root.Open(name)
+		if err1 == nil {
+			return name, f, nil
+		}
+		if !errors.Is(err1, fs.ErrNotExist) {
+			return "", nil, err1
+		}
+		if err == nil {
+			err = err1
+		}
+	}
+	if err == nil {
+		err = &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return "", nil, err
+}
+
+// SetResolver sets the Resolver used to find included files, in place of
+// the file system passed to [NewExpandingDecoder] and any include path set
+// with [ExpandingDecoder.SetIncludePath]. That file system is still used to
+// open the file the decoder was created with.
+//
+// SetResolver must be called before the first call to Decode.
+func (d *ExpandingDecoder) SetResolver(r Resolver) {
+	d.resolver = r
+}
+
+// SetIncludePath sets the file systems searched, in order, for included
+// files not found in the file system the decoder was created with. A search
+// path might hold a vendor directory followed by a standard library of
+// templates. It is shorthand for
+//
+//	d.SetResolver(FSResolver(append([]fs.FS{fsys}, roots...)...))
+//
+// Each include path is looked up as is in every file system; it is not
+// relative to the file containing the include, so a file in one file system
+// may include a file from another.
+//
+// SetIncludePath must be called before the first call to Decode.
+func (d *ExpandingDecoder) SetIncludePath(roots ...fs.FS) {
+	d.resolver = FSResolver(append([]fs.FS{d.fsys}, roots...)...)
+}
@@ -0,0 +1,170 @@
+package linebased
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"time"
+)
+
+// A TemplateSet is a compiled, immutable set of templates shared by many
+// [ExpandingDecoder] values. Building a set once saves each decoder from
+// reading and parsing the same library files again.
+//
+// A TemplateSet is safe for concurrent use by multiple goroutines.
+type TemplateSet struct {
+	defs  map[defKey]template
+	files map[string]setFile // files parsed into the set, by identity
+}
+
+// A setFile records a file parsed into a TemplateSet, to recognize it when
+// a decoder using the set includes a file of the same name.
+type setFile struct {
+	sum     [sha256.Size]byte // hash of the contents
+	size    int64
+	modTime time.Time // zero if the file did not report it
+}
+
+// same reports whether info, if not nil, describes f by its size and
+// modification time. A file without a modification time is never the same.
+func (f setFile) same(info fs.FileInfo) bool {
+	return info != nil && !f.modTime.IsZero() && info.Size() == f.size && info.ModTime().Equal(f.modTime)
+}
+
+// statFile returns the FileInfo of f, if it has a Stat method that
+// succeeds, or nil.
+func statFile(f any) fs.FileInfo {
+	stat, ok := f.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return nil
+	}
+	info, err := stat.Stat()
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// ParseTemplates returns a TemplateSet holding the templates defined by the
+// named files in fsys and by the files they include. The files may contain
+// only defines, includes, comments, and blank lines.
+func ParseTemplates(fsys fs.FS, names ...string) (*TemplateSet, error) {
+	s := &TemplateSet{
+		defs:  make(map[defKey]template),
+		files: make(map[string]setFile),
+	}
+	for _, name := range names {
+		if _, ok := s.files[name]; ok {
+			continue
+		}
+		d := newExpandingDecoder(name, fsys, s)
+		for {
+			expr, err := d.Decode()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if expr.Name != "" {
+				d.close()
+				return nil, &ExpressionError{
+					Expanded: expr,
+					Err:      errors.New("template files may contain only define and include"),
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// Files returns the sorted names of the files parsed into s.
+func (s *TemplateSet) Files() []string {
+	return slices.Sorted(maps.Keys(s.files))
+}
+
+// SetTemplates makes the templates in s available to the decoder, as if
+// they had been defined before the first line of its input. Including a
+// file that was parsed into s does nothing, since its templates are already
+// defined. Defining a template of the same name as one in s is an error.
+//
+// Files are known by name, and s may have been parsed from another file
+// system than the decoder reads. An include of a file in s that the decoder
+// cannot find is taken from s. If the decoder finds the file, it checks that
+// it is the file in s; including a different file of the same name is an
+// error. The check costs an open and a Stat when the file reports the same
+// size and modification time as when s was parsed. Otherwise, as for files
+// without a modification time, the decoder reads the file and compares its
+// contents.
+//
+// SetTemplates must be called before the first call to Decode.
+func (d *ExpandingDecoder) SetTemplates(s *TemplateSet) {
+	d.set = s
+}
+
+// setFile returns the first of the named files in the template set, if any.
+func (d *ExpandingDecoder) setFile(names ...string) (setFile, bool) {
+	if d.set == nil {
+		return setFile{}, false
+	}
+	for _, name := range names {
+		if file, ok := d.set.files[name]; ok {
+			return file, true
+		}
+	}
+	return setFile{}, false
+}
+
+// checkSetFile reports an error if the file read from r, with identity id
+// and included by expr, is not file, the file of the same name in the
+// template set.
+func (d *ExpandingDecoder) checkSetFile(expr Expanded, id string, r io.Reader, file setFile) error {
+	if file.same(statFile(r)) {
+		return nil
+	}
+	limit := d.limits.MaxIncludeBytes
+	if limit > 0 {
+		r = &limitReader{r: r, n: limit}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		if errors.Is(err, errIncludeTooLarge) {
+			return d.includeSizeError(expr, limit)
+		}
+		return &ExpressionError{Expanded: expr, Err: err}
+	}
+	if [sha256.Size]byte(h.Sum(nil)) != file.sum {
+		return &ExpressionError{
+			Expanded: expr,
+			Err:      fmt.Errorf("%s: %s is not the file of the same name in the template set", expr.Name, id),
+		}
+	}
+	return nil
+}
+
+// setDefs returns the templates of the template set used by the decoder,
+// or nil.
+func (d *ExpandingDecoder) setDefs() map[defKey]template {
+	if d.set == nil || d.building {
+		return nil
+	}
+	return d.set.defs
+}
+
+// lookup returns the template with the given name visible in the file with
+// identity scope, if any.
+func (d *ExpandingDecoder) lookup(name, scope string) (template, bool) {
+	key := makeKey(name, scope)
+	if t, ok := d.defs[key]; ok {
+		return t, true
+	}
+	if d.set != nil && !d.building {
+		t, ok := d.set.defs[key]
+		return t, ok
+	}
+	return template{}, false
+}